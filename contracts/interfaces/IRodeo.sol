@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.8.0;
+
+// Deployed Rodeo contracts the app reads from or sends to whose sources
+// aren't in this repo, declared so they get ABI artifacts in out/
+
+interface IAppHelper {
+    function pool(address pool)
+        external
+        view
+        returns (
+            bool paused,
+            uint256 borrowMin,
+            uint256 cap,
+            uint256 index,
+            uint256 shares,
+            uint256 borrow,
+            uint256 supply,
+            uint256 rate,
+            uint256 price
+        );
+}
+
+interface ILendingPool {
+    function getTotalLiquidity() external view returns (uint256);
+}
+
+interface IFarm {
+    function tvl() external view returns (uint256);
+}
+
+interface IXrdo {
+    function plugins(uint256 index) external view returns (uint256);
+    function getUser(address user, uint256 plugins)
+        external
+        view
+        returns (uint256 balance, uint256 allocated, uint256[] memory allocations);
+}
+
+interface ITokenStakingDividends {
+    function claimable(address user, uint256 token) external view returns (uint256);
+}
+
+interface ISTIPDistributor {
+    function getClaimed(uint256[] calldata indexes, address user) external view returns (uint256[] memory);
+}
+
+interface IVester {
+    function schedulesCount(address user) external view returns (uint256);
+    function getSchedules(address user, uint256 from, uint256 to)
+        external
+        view
+        returns (uint256[] memory amounts, uint256[] memory claimeds, uint256[] memory availables);
+    function getSchedulesInfo(address user, uint256 from, uint256 to)
+        external
+        view
+        returns (
+            uint256[] memory sources,
+            address[] memory tokens,
+            uint256[] memory initials,
+            uint256[] memory times,
+            uint256[] memory starts
+        );
+}
+
+interface IAutomation {
+    function canRun() external view returns (bytes memory);
+    function run(bytes calldata data) external;
+}
+
+interface IVaultStrategy {
+    function info()
+        external
+        view
+        returns (int256 profit, uint256 leverage, uint256 assets, uint256 balance, uint256 debt);
+    function act(uint256 kind, uint256 amount, uint256 borrow, uint256 minimum, address target, bytes calldata data)
+        external;
+}
@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"app/lib"
+	"app/models"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// The /api/v1/ endpoints return the data the app pages show as JSON, with
+// camelCased field names. Amounts are decimal strings in their token's units
+// (USD values have 18 decimals). Lists are paginated with `page` (from 1) and
+// `limit` (up to 250), and all responses carry an ETag so clients can
+// revalidate them cheaply.
+
+const apiMaxAge = time.Minute
+
+type apiLeaderboardUser struct {
+	Rank           int64  `json:"rank"`
+	Address        string `json:"address"`
+	SocialName     string `json:"socialName"`
+	SocialUsername string `json:"socialUsername"`
+	SocialPicture  string `json:"socialPicture"`
+	Points         int64  `json:"points"`
+	PointsReferral int64  `json:"pointsReferral"`
+}
+
+// apiPosition is models.Position with the camelCased field names of the API,
+// the model keeps the snake_cased ones the app's scripts read
+type apiPosition struct {
+	Id          int64       `json:"id"`
+	Chain       int64       `json:"chain"`
+	Index       int64       `json:"index"`
+	Pool        string      `json:"pool"`
+	Strategy    int64       `json:"strategy"`
+	Shares      *lib.BigInt `json:"shares"`
+	Borrow      *lib.BigInt `json:"borrow"`
+	SharesValue *lib.BigInt `json:"sharesValue"`
+	BorrowValue *lib.BigInt `json:"borrowValue"`
+	Life        *lib.BigInt `json:"life"`
+	Amount      *lib.BigInt `json:"amount"`
+	Price       *lib.BigInt `json:"price"`
+	Created     time.Time   `json:"created"`
+	Updated     time.Time   `json:"updated"`
+	Owner       string      `json:"owner"`
+	Token       string      `json:"token"`
+	Collateral  *lib.BigInt `json:"collateral"`
+}
+
+// apiAnalyticsData is analyticsData with its position rankings as apiPositions
+type apiAnalyticsData struct {
+	analyticsData
+	Largest []*apiPosition `json:"largest"`
+	Profit  []*apiPosition `json:"profit"`
+	Danger  []*apiPosition `json:"danger"`
+}
+
+func apiPositions(positions []*models.Position) []*apiPosition {
+	items := []*apiPosition{}
+	for _, p := range positions {
+		items = append(items, &apiPosition{
+			Id:          p.Id,
+			Chain:       p.Chain,
+			Index:       p.Index,
+			Pool:        p.Pool,
+			Strategy:    p.Strategy,
+			Shares:      p.Shares,
+			Borrow:      p.Borrow,
+			SharesValue: p.SharesValue,
+			BorrowValue: p.BorrowValue,
+			Life:        p.Life,
+			Amount:      p.Amount,
+			Price:       p.Price,
+			Created:     p.Created,
+			Updated:     p.Updated,
+			Owner:       p.Owner,
+			Token:       p.Token,
+			Collateral:  p.Collateral,
+		})
+	}
+	return items
+}
+
+// apiPage reads the pagination params, returning the page, its size and the offset it starts at
+func apiPage(c *lib.Ctx) (int64, int64, int64) {
+	page, err := strconv.ParseInt(c.Param("page", "1"), 10, 64)
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.ParseInt(c.Param("limit", "50"), 10, 64)
+	if err != nil || limit < 1 || limit > 250 {
+		limit = 50
+	}
+	return page, limit, (page - 1) * limit
+}
+
+// apiList sends one page of a list, given the page's items and how many there are in total
+func apiList(c *lib.Ctx, items interface{}, total int64) {
+	page, limit, _ := apiPage(c)
+	c.JSONCached(lib.J{"data": items, "page": page, "limit": limit, "total": total}, apiMaxAge)
+}
+
+// apiBounds returns the start and end of the requested page in a list of length total
+func apiBounds(c *lib.Ctx, total int) (int, int) {
+	_, limit, offset := apiPage(c)
+	start := int(offset)
+	if start > total {
+		start = total
+	}
+	end := start + int(limit)
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+func apiAddress(c *lib.Ctx) (string, bool) {
+	address := c.Param("address", "")
+	if !common.IsHexAddress(address) {
+		c.JSON(400, lib.J{"error": "invalid address"})
+		return "", false
+	}
+	return common.HexToAddress(address).String(), true
+}
+
+func ApiPool(c *lib.Ctx) {
+	pool := &models.PoolInfo{}
+	c.Cache.Try("pool", pool, time.Minute, cachePool(c))
+	c.JSONCached(lib.J{"data": pool}, apiMaxAge)
+}
+
+func ApiStrategies(c *lib.Ctx) {
+	strategies := models.Strategies
+	c.Cache.Try("strategies", &strategies, 5*time.Minute, cacheStrategies(c))
+	start, end := apiBounds(c, len(strategies))
+	apiList(c, strategies[start:end], int64(len(strategies)))
+}
+
+func ApiCollaterals(c *lib.Ctx) {
+	collaterals := []*models.Collateral{}
+	c.Cache.Try("collaterals", &collaterals, 5*time.Minute, cacheCollaterals(c))
+	start, end := apiBounds(c, len(collaterals))
+	apiList(c, collaterals[start:end], int64(len(collaterals)))
+}
+
+// ApiPositions lists the indexed positions of an owner, newest first
+func ApiPositions(c *lib.Ctx) {
+	address, ok := apiAddress(c)
+	if !ok {
+		return
+	}
+	page, limit, _ := apiPage(c)
+	positions := []*models.Position{}
+	p := c.DB.Query(&positions).Where("chain = $1 and lower(owner) = lower($2)", models.DefaultChainId, address).
+		OrderBy(`"index" desc`).Paginate(&positions, page, limit)
+	apiList(c, apiPositions(positions), p.Total)
+}
+
+func ApiVesting(c *lib.Ctx) {
+	address, ok := apiAddress(c)
+	if !ok {
+		return
+	}
+	vestings, err := vestingsFor(c.Context(), c.Server.ChainClients[models.DefaultChainId], address)
+	if err != nil {
+		lib.LogError("chain read failed", lib.J{"path": c.Req.URL.Path, "error": err.Error()})
+		c.JSON(502, lib.J{"error": "couldn't read vesting schedules"})
+		return
+	}
+	start, end := apiBounds(c, len(vestings))
+	apiList(c, vestings[start:end], int64(len(vestings)))
+}
+
+func ApiAnalytics(c *lib.Ctx) {
+	data := analyticsData{}
+	c.Cache.Try("analytics", &data, 15*time.Minute, cacheAnalytics(c))
+	c.JSONCached(lib.J{"data": &apiAnalyticsData{
+		analyticsData: data,
+		Largest:       apiPositions(data.Largest),
+		Profit:        apiPositions(data.Profit),
+		Danger:        apiPositions(data.Danger),
+	}}, apiMaxAge)
+}
+
+// ApiAnalyticsPositions pages through one of the analytics position rankings, live rather than cached
+func ApiAnalyticsPositions(c *lib.Ctx) {
+	q := analyticsPositions(c.DB, c.Param("list", ""))
+	if q == nil {
+		c.JSON(404, lib.J{"error": "unknown list"})
+		return
+	}
+	page, limit, _ := apiPage(c)
+	positions := []*models.Position{}
+	p := q.Paginate(&positions, page, limit)
+	apiList(c, apiPositions(positions), p.Total)
+}
+
+func ApiLeaderboard(c *lib.Ctx) {
+	page, limit, offset := apiPage(c)
+	users := []*models.LeaderboardUser{}
+	p := c.DB.Query(&users).OrderBy("points desc").OrderBy("created asc").Paginate(&users, page, limit)
+	ranked := []*apiLeaderboardUser{}
+	for i, u := range users {
+		ranked = append(ranked, &apiLeaderboardUser{
+			Rank:           offset + int64(i) + 1,
+			Address:        u.Address,
+			SocialName:     u.SocialName,
+			SocialUsername: u.SocialUsername,
+			SocialPicture:  u.SocialPicture,
+			Points:         u.Points,
+			PointsReferral: u.PointsReferral,
+		})
+	}
+	apiList(c, ranked, p.Total)
+}
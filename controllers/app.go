@@ -3,20 +3,23 @@ package controllers
 import (
 	"app/lib"
 	"app/models"
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"math/big"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
-var _ = lib.RegisterSchedule("cache-prime-1m", time.Hour)
+var _ = lib.RegisterSchedule("cache-prime-1m", time.Minute)
 var _ = lib.RegisterJob("cache-prime-1m", func(c *lib.Ctx, args lib.J) {
 	c.Cache.Set("pool", cachePool(c)(), 75*time.Second)
 })
-var _ = lib.RegisterSchedule("cache-prime-5m", time.Hour)
+var _ = lib.RegisterSchedule("cache-prime-5m", 5*time.Minute)
 var _ = lib.RegisterJob("cache-prime-5m", func(c *lib.Ctx, args lib.J) {
 	c.Cache.Set("strategies", cacheStrategies(c)(), 6*time.Minute)
 	c.Cache.Set("collaterals", cacheCollaterals(c)(), 6*time.Minute)
@@ -25,8 +28,9 @@ var _ = lib.RegisterJob("cache-prime-5m", func(c *lib.Ctx, args lib.J) {
 func cacheStrategies(c *lib.Ctx) func() interface{} {
 	return func() interface{} {
 		client := c.Server.ChainClients[models.DefaultChainId]
-		poolInfo := client.Call(models.AddressHelper, "pool-address-bool,uint256,uint256,uint256,uint256,uint256,uint256,uint256,uint256", models.Pools[0].Address)
-		borrowApy := lib.Bni(poolInfo[7]).Mul(lib.YEAR)
+		poolInfo := models.HelperPool{}
+		client.CallMethod(&poolInfo, models.HelperPoolInfo, models.AddressHelper, models.Pools[0].Address)
+		borrowApy := poolInfo.Rate.Mul(lib.YEAR)
 		strategies := models.Strategies
 		defillamaPools := struct {
 			Data []struct {
@@ -37,12 +41,14 @@ func cacheStrategies(c *lib.Ctx) func() interface{} {
 		}{}
 		lib.GetJSON("https://yields.llama.fi/pools", &defillamaPools, nil)
 		for _, s := range strategies {
-			result := client.Call(models.AddressInvestor, "getStrategy-uint256-address,uint256,uint256", big.NewInt(s.Index))
-			s.Address = result[0].(common.Address).String()
-			s.Cap = lib.Bni(result[1])
-			s.Status = lib.Bni(result[2]).Std().Int64()
-			totalShares := lib.Bni(client.Call(s.Address, "totalShares--uint256")[0])
-			s.Tvl = lib.Bni(client.Call(s.Address, "rate-uint256-uint256", totalShares)[0])
+			strategy := models.InvestorStrategy{}
+			client.CallMethod(&strategy, models.InvestorGetStrategy, models.AddressInvestor, big.NewInt(s.Index))
+			s.Address = strategy.Implementation.String()
+			s.Cap = strategy.Cap
+			s.Status = strategy.Status.Std().Int64()
+			var totalShares *lib.BigInt
+			client.CallMethod(&totalShares, models.StrategyTotalShares, s.Address)
+			client.CallMethod(&s.Tvl, models.StrategyRate, s.Address, totalShares)
 			if s.ApyType == "defillama" {
 				for _, p := range defillamaPools.Data {
 					if s.ApyId == p.Pool {
@@ -62,22 +68,26 @@ func cacheCollaterals(c *lib.Ctx) func() interface{} {
 	return func() interface{} {
 		client := c.Server.ChainClients[models.DefaultChainId]
 		collaterals := []*models.Collateral{}
-		for _, t := range models.Collaterals {
-			d := client.Call(t.Oracle, "decimals--uint8")[0].(uint8)
-			price := lib.Bni(client.Call(t.Oracle, "latestAnswer--int256")[0]).Mul(lib.ONE).Div(lib.Bn(1, int64(d)))
-			balance := lib.Bni(client.Call(t.Address, "balanceOf-address-uint256", models.AddressBank)[0])
-			key0 := crypto.Keccak256(common.LeftPadBytes(common.HexToAddress(t.Address).Bytes(), 32), common.FromHex("0xb3bc6d089762efe6c36fe824d78650881aa025aca8a39468c3c09ce8509152e0"))
-			var key [32]byte
-			copy(key[:], key0[:32])
-			cap := lib.Bni(client.Call(models.AddressStore, "getUint-bytes32-uint256", key)[0])
-			collaterals = append(collaterals, &models.Collateral{
+		decimals := make([]uint8, len(models.Collaterals))
+		batch := client.Batch()
+		for i, t := range models.Collaterals {
+			collateral := &models.Collateral{
 				Token:           t,
-				Price:           price,
-				Balance:         balance,
 				UserBalance:     lib.ZERO,
 				PositionBalance: lib.ZERO,
-				Cap:             cap,
-			})
+			}
+			key0 := crypto.Keccak256(common.LeftPadBytes(common.HexToAddress(t.Address).Bytes(), 32), common.FromHex("0xb3bc6d089762efe6c36fe824d78650881aa025aca8a39468c3c09ce8509152e0"))
+			var key [32]byte
+			copy(key[:], key0[:32])
+			batch.CallMethod(&decimals[i], models.OracleDecimals, t.Oracle)
+			batch.CallMethod(&collateral.Price, models.OracleLatestAnswer, t.Oracle)
+			batch.CallMethod(&collateral.Balance, models.ERC20BalanceOf, t.Address, models.AddressBank)
+			batch.CallMethod(&collateral.Cap, models.StoreGetUint, models.AddressStore, key)
+			collaterals = append(collaterals, collateral)
+		}
+		batch.Run()
+		for i, collateral := range collaterals {
+			collateral.Price = collateral.Price.Mul(lib.ONE).Div(lib.Bn(1, int64(decimals[i])))
 		}
 		return collaterals
 	}
@@ -87,28 +97,41 @@ func cachePool(c *lib.Ctx) func() interface{} {
 	return func() interface{} {
 		client := c.Server.ChainClients[models.DefaultChainId]
 		pool := models.Pools[0]
-		result := client.Call(models.AddressHelper, "pool-address-bool,uint256,uint256,uint256,uint256,uint256,uint256,uint256,uint256", pool.Address)
-		pool.Paused = result[0].(bool)
-		pool.BorrowMin = lib.Bni(result[1])
-		pool.Cap = lib.Bni(result[2])
-		pool.Index = lib.Bni(result[3])
-		pool.Shares = lib.Bni(result[4])
-		pool.Borrow = lib.Bni(result[5])
-		pool.Supply = lib.Bni(result[6])
-		pool.Rate = lib.Bni(result[7]).Mul(lib.Bnf(365*24*60*60, 0))
-		pool.Price = lib.Bni(result[8])
+		result := models.HelperPool{}
+		client.CallMethod(&result, models.HelperPoolInfo, models.AddressHelper, pool.Address)
+		pool.Paused = result.Paused
+		pool.BorrowMin = result.BorrowMin
+		pool.Cap = result.Cap
+		pool.Index = result.Index
+		pool.Shares = result.Shares
+		pool.Borrow = result.Borrow
+		pool.Supply = result.Supply
+		pool.Rate = result.Rate.Mul(lib.Bnf(365*24*60*60, 0))
+		pool.Price = result.Price
 		pool.SupplyRate = lib.ZERO
 		pool.Utilisation = lib.ZERO
 		if pool.Supply.Gt(lib.ZERO) {
 			pool.Utilisation = pool.Borrow.Mul(lib.ONE).Div(pool.Supply)
 			pool.SupplyRate = pool.Rate.Mul(pool.Utilisation).Div(lib.ONE)
 		}
-		arbPrice := client.CallUint("0x3AC1bfc26e8c3FcF55e8E41DBb7910b38Da62eBD", "latestAnswer--int256")
+		var arbPrice *lib.BigInt
+		client.CallMethod(&arbPrice, models.OracleLatestAnswer, "0x3AC1bfc26e8c3FcF55e8E41DBb7910b38Da62eBD")
 		pool.ArbRate = lib.Bn(250_000, 10).Mul(arbPrice).Mul(lib.Bn(26, 18)).Div(pool.Supply.Add(pool.Borrow).Mul(lib.ONE12))
 		return pool
 	}
 }
 
+// chainFailed logs a failed read of user specific chain data and flags the page
+// so it can still render with what we have instead of erroring out
+func chainFailed(c *lib.Ctx, err error) bool {
+	if err == nil {
+		return false
+	}
+	lib.LogError("chain read failed", lib.J{"path": c.Req.URL.Path, "error": err.Error()})
+	c.Data["chainError"] = "Some on-chain data couldn't be loaded, balances shown may be incomplete. Try refreshing in a moment."
+	return true
+}
+
 func AppStrategies(c *lib.Ctx) {
 	client := c.Server.ChainClients[models.DefaultChainId]
 	pool := &models.PoolInfo{}
@@ -139,15 +162,52 @@ func AppStrategies(c *lib.Ctx) {
 	positionApys := map[int64]*lib.BigInt{}
 	positionMaxBorrows := map[int64]*lib.BigInt{}
 	whitelisted := false
+	healths := []*models.PositionHealth{}
+	var portfolio *models.Portfolio
 	if address := c.GetCookie("address"); address != "" {
-		positionCount := lib.Bni(client.Call(models.AddressPositionManager, "balanceOf-address-uint256", address)[0])
-		positionIds := client.Call(models.AddressPositionManager, "tokensOfOwner-address,uint256,uint256-uint256[]", address, big.NewInt(0), positionCount.Std())[0].([]*big.Int)
-		for _, id := range positionIds {
-			position := client.Call(models.AddressInvestor, "getPosition-uint256-address,uint256,uint256,address,uint256,uint256,uint256,uint256", id)
-			if lib.Bni(position[4]).Eq(lib.ZERO) {
+		// Levels from the health monitor, to warn before positions get killed
+		c.DB.All(&healths, `select * from position_healths where lower(owner) = lower($1) and level <> $2 order by life asc`, address, models.PositionHealthOk)
+		// Cached briefly, it's the same on every page load until the next snapshot
+		portfolio = &models.Portfolio{}
+		c.Cache.Try("portfolio-"+strings.ToLower(address), portfolio, time.Minute, func() interface{} {
+			return models.PortfolioFor(c, address, 30)
+		})
+
+		var positionCount *lib.BigInt
+		positionIds := []*lib.BigInt{}
+		err := client.CallMethodErr(c.Context(), &positionCount, models.PositionManagerBalanceOf, models.AddressPositionManager, address)
+		if err == nil {
+			err = client.CallMethodErr(c.Context(), &positionIds, models.PositionManagerTokensOfOwner, models.AddressPositionManager, address, lib.ZERO, positionCount)
+		}
+		if chainFailed(c, err) {
+			positionIds = []*lib.BigInt{}
+		}
+
+		batch := client.Batch()
+		investorPositions := make([]models.InvestorPosition, len(positionIds))
+		for i, id := range positionIds {
+			batch.CallMethod(&investorPositions[i], models.InvestorGetPosition, models.AddressInvestor, id)
+		}
+		for _, c := range collaterals {
+			batch.CallMethod(&c.UserBalance, models.ERC20BalanceOf, c.Token.Address, address)
+		}
+		batch.CallMethod(&whitelisted, models.WhitelistCheck, models.AddressWhitelist, address)
+		if chainFailed(c, batch.RunErr(c.Context())) {
+			investorPositions = make([]models.InvestorPosition, len(positionIds))
+			for _, c := range collaterals {
+				c.UserBalance = lib.ZERO
+			}
+			whitelisted = false
+		}
+
+		batch = client.Batch()
+
+		for i, id := range positionIds {
+			position := investorPositions[i]
+			if position.Collateral == nil || position.Collateral.Eq(lib.ZERO) {
 				continue
 			}
-			strategyIndex := lib.Bni(position[2]).Std().Int64()
+			strategyIndex := position.Strategy.Std().Int64()
 			strategyAddress := ""
 			strategyApy := lib.ZERO
 			for _, s := range models.Strategies {
@@ -157,35 +217,36 @@ func AppStrategies(c *lib.Ctx) {
 				}
 			}
 			p := &models.Position{
-				Index:       id.Int64(),
+				Index:       id.Std().Int64(),
 				Strategy:    strategyIndex,
-				Token:       position[3].(common.Address).String(),
-				Collateral:  lib.Bni(position[4]),
-				Shares:      lib.Bni(position[6]),
-				SharesValue: lib.Bni(client.Call(strategyAddress, "rate-uint256-uint256", lib.Bni(position[6]))[0]),
-				Borrow:      lib.Bni(position[5]),
-				BorrowValue: lib.Bni(position[5]).Mul(pool.Index).Div(lib.ONE6),
-				Amount:      lib.Bni(position[7]),
-				Created:     time.Unix(lib.Bni(position[1]).Std().Int64(), 0),
+				Token:       position.Token.String(),
+				Collateral:  position.Collateral,
+				Shares:      position.Shares,
+				Borrow:      position.Borrow,
+				BorrowValue: position.Borrow.Mul(pool.Index).Div(lib.ONE6),
+				Amount:      position.Basis,
+				Created:     time.Unix(position.Start.Std().Int64(), 0),
 			}
+			batch.CallMethod(&p.SharesValue, models.StrategyRate, strategyAddress, position.Shares)
 			positions = append(positions, p)
+			positionApys[p.Index] = strategyApy
+		}
+		if chainFailed(c, batch.RunErr(c.Context())) {
+			positions = []*models.Position{}
+		}
+
+		for _, p := range positions {
 			token := models.Tokens[p.Token]
 			collateralValue := p.Collateral.Mul(tokenPrices[token.Address]).Div(lib.Bn(1, token.Decimals))
-			positionLeverages[id.Int64()] = p.SharesValue.Mul(lib.ONE).Div(collateralValue)
-			positionApys[id.Int64()] = strategyApy.Mul(positionLeverages[id.Int64()]).Div(lib.ONE)
-			positionMaxBorrows[id.Int64()] = collateralValue.Mul(lib.Bn(10, 0)).Sub(p.BorrowValue)
+			positionLeverages[p.Index] = p.SharesValue.Mul(lib.ONE).Div(collateralValue)
+			positionApys[p.Index] = positionApys[p.Index].Mul(positionLeverages[p.Index]).Div(lib.ONE)
+			positionMaxBorrows[p.Index] = collateralValue.Mul(lib.Bn(10, 0)).Sub(p.BorrowValue)
 			for _, c := range collaterals {
 				if c.Token.Address == p.Token {
 					c.PositionBalance = c.PositionBalance.Add(p.Collateral)
 				}
 			}
 		}
-
-		for _, c := range collaterals {
-			c.UserBalance = client.CallUint(c.Token.Address, "balanceOf-address-uint256", address)
-		}
-
-		whitelisted = client.Call(models.AddressWhitelist, "check-address-bool", address)[0].(bool)
 	}
 
 	strategyPositions := map[int64][]*models.Position{}
@@ -217,8 +278,10 @@ func AppStrategies(c *lib.Ctx) {
 	balance := lib.ZERO
 	tokenAllowance := lib.ZERO
 	if address := c.GetCookie("address"); address != "" {
-		balance = lib.Bni(client.Call(tokenAddress, "balanceOf-address-uint256", address)[0])
-		tokenAllowance = lib.Bni(client.Call(tokenAddress, "allowance-address,address-uint256", address, models.AddressPositionManager)[0])
+		batch := client.Batch()
+		batch.CallMethod(&balance, models.ERC20BalanceOf, tokenAddress, address)
+		batch.CallMethod(&tokenAllowance, models.ERC20Allowance, tokenAddress, address, models.AddressPositionManager)
+		chainFailed(c, batch.RunErr(c.Context()))
 	}
 
 	totalTvl := pool.Supply.Mul(lib.ONE12)
@@ -250,6 +313,9 @@ func AppStrategies(c *lib.Ctx) {
 		"positionApys":       positionApys,
 		"positionMaxBorrows": positionMaxBorrows,
 		"whitelisted":        whitelisted,
+		"healths":            healths,
+		"portfolio":          portfolio,
+		"portfolioBars":      portfolioBars(portfolio),
 
 		"earnApy":        pool.Rate,
 		"strategy":       strategy,
@@ -272,6 +338,58 @@ func AppStrategies(c *lib.Ctx) {
 	})
 }
 
+// AppPortfolio returns the PnL history of an address's positions, over the last
+// `days` days (30 by default, up to a year)
+func AppPortfolio(c *lib.Ctx) {
+	address := c.Param("address", "")
+	if !common.IsHexAddress(address) {
+		c.JSON(400, lib.J{"error": "invalid address"})
+		return
+	}
+	days := lib.StringToInt(c.Param("days", "30"))
+	if days < 1 || days > 365 {
+		days = 30
+	}
+	c.JSON(200, models.PortfolioFor(c, address, int(days)))
+}
+
+type portfolioBar struct {
+	X        int
+	Y        int
+	Width    int
+	Height   int
+	Negative bool
+	Title    string
+}
+
+// portfolioBars lays out the daily PnL of a portfolio as bars of a 600x120 chart
+// centered on zero
+func portfolioBars(p *models.Portfolio) []*portfolioBar {
+	bars := []*portfolioBar{}
+	if p == nil || len(p.Days) == 0 {
+		return bars
+	}
+	max := 0.0
+	for _, d := range p.Days {
+		max = math.Max(max, math.Abs(d.DailyPnl.Float()))
+	}
+	width := 600 / len(p.Days)
+	for i, d := range p.Days {
+		value := d.DailyPnl.Float()
+		height := 0
+		if max > 0 {
+			height = int(math.Abs(value) / max * 60)
+		}
+		bar := &portfolioBar{X: i * width, Y: 60 - height, Width: width - 2, Height: height, Negative: value < 0,
+			Title: fmt.Sprintf("%s: $%.2f PnL, $%.2f fees, $%.2f interest", d.Date.Format("Jan 2"), value/1e18, d.Fees.Float()/1e18, d.Interest.Float()/1e18)}
+		if bar.Negative {
+			bar.Y = 60
+		}
+		bars = append(bars, bar)
+	}
+	return bars
+}
+
 func AppStrategy(c *lib.Ctx) {
 	strategies := models.Strategies
 	c.Cache.Try("strategies", &strategies, 5*time.Minute, cacheStrategies(c))
@@ -304,10 +422,18 @@ func AppLend(c *lib.Ctx) {
 	balanceAsset := lib.ZERO
 	allowance := lib.ZERO
 	if address != "" {
-		balanceShares = client.CallUint(pool.Address, "balanceOf-address-uint256", address)
-		balanceLent = balanceShares.Mul(pool.Index).Div(lib.ONE)
-		balanceAsset = client.CallUint(pool.Asset, "balanceOf-address-uint256", address)
-		allowance = lib.Bni(client.Call(pool.Asset, "allowance-address,address-uint256", address, pool.Address)[0])
+		// Read into temporaries so a failed batch doesn't show half its results
+		var shares, asset, allowed *lib.BigInt
+		batch := client.Batch()
+		batch.CallMethod(&shares, models.ERC20BalanceOf, pool.Address, address)
+		batch.CallMethod(&asset, models.ERC20BalanceOf, pool.Asset, address)
+		batch.CallMethod(&allowed, models.ERC20Allowance, pool.Asset, address, pool.Address)
+		if err := batch.RunErr(c.Context()); !chainFailed(c, err) {
+			balanceShares = shares
+			balanceAsset = asset
+			allowance = allowed
+			balanceLent = balanceShares.Mul(pool.Index).Div(lib.ONE)
+		}
 	}
 
 	c.Render(200, "app/lend", lib.J{
@@ -323,7 +449,13 @@ func AppLend(c *lib.Ctx) {
 
 func AppStaking(c *lib.Ctx) {
 	client := c.Server.ChainClients[models.DefaultChainId]
-	total := lib.Bni(client.Call(models.AddressXrdo, "plugins-uint256-uint256", lib.Bn(0, 0))[0])
+	var total *lib.BigInt
+	apy := lib.ZERO
+	if err := client.CallMethodErr(c.Context(), &total, models.XrdoPlugins, models.AddressXrdo, lib.Bn(0, 0)); chainFailed(c, err) {
+		total = lib.ZERO
+	} else if total.Gt(lib.ZERO) {
+		apy = lib.Bn(239824, 36).Div(total)
+	}
 
 	address := c.GetCookie("address")
 	balance := lib.ZERO
@@ -332,18 +464,32 @@ func AppStaking(c *lib.Ctx) {
 	dividendsRdo := lib.ZERO
 	dividendsUsdc := lib.ZERO
 	if address != "" {
-		balance = lib.Bni(client.Call(models.AddressRdo, "balanceOf-address-uint256", address)[0])
-		deposited = lib.Bni(client.Call(models.AddressXrdo, "getUser-address,uint256-uint256,uint256,uint256[]", address, lib.Bn(3, 0))[2].([]*big.Int)[0])
-		allowance = lib.Bni(client.Call(models.AddressRdo, "allowance-address,address-uint256", address, models.AddressXrdo)[0])
-		dividendsRdo = lib.Bni(client.Call(models.AddressTokenStakingDividends, "claimable-address,uint256-uint256", address, lib.Bn(0, 0))[0])
-		dividendsUsdc = lib.Bni(client.Call(models.AddressTokenStakingDividends, "claimable-address,uint256-uint256", address, lib.Bn(1, 0))[0])
+		// Read into temporaries so a failed batch doesn't show half its results
+		batch := client.Batch()
+		var rdoBalance, rdoAllowance *lib.BigInt
+		batch.CallMethod(&rdoBalance, models.ERC20BalanceOf, models.AddressRdo, address)
+		batch.CallMethod(&rdoAllowance, models.ERC20Allowance, models.AddressRdo, address, models.AddressXrdo)
+		user := models.XrdoUser{}
+		var claimableRdo, claimableUsdc *lib.BigInt
+		batch.CallMethod(&user, models.XrdoGetUser, models.AddressXrdo, address, lib.Bn(3, 0))
+		batch.CallMethod(&claimableRdo, models.StakingDividendsClaimable, models.AddressTokenStakingDividends, address, lib.Bn(0, 0))
+		batch.CallMethod(&claimableUsdc, models.StakingDividendsClaimable, models.AddressTokenStakingDividends, address, lib.Bn(1, 0))
+		if err := batch.RunErr(c.Context()); !chainFailed(c, err) {
+			balance = rdoBalance
+			allowance = rdoAllowance
+			if len(user.Allocations) > 0 {
+				deposited = user.Allocations[0]
+			}
+			dividendsRdo = claimableRdo
+			dividendsUsdc = claimableUsdc
+		}
 	}
 	c.Render(200, "app/staking", lib.J{
 		"title":                 "Silo",
 		"rdo":                   models.AddressRdo,
 		"xrdo":                  models.AddressXrdo,
 		"tokenStakingDividends": models.AddressTokenStakingDividends,
-		"apy":                   lib.Bn(239824, 36).Div(total),
+		"apy":                   apy,
 		"total":                 total,
 		"balance":               balance,
 		"deposited":             deposited,
@@ -361,9 +507,12 @@ func AppRewards(c *lib.Ctx) {
 		Earn *lib.BigInt
 	}{}
 	c.Cache.Try("rewards", &data, 15*time.Minute, func() interface{} {
-		arbPrice := lib.Bni(client.Call("0xb2A824043730FE05F3DA2efaFa1CBbe83fa548D6", "latestAnswer--int256")[0]).Mul(lib.ONE10)
-		farmSupply := lib.Bni(client.Call("0x72b9E266b4F531A5a41fE56D5B2ae1Bafba196c0", "tvl--uint256")[0])
-		earnSupply := lib.Bni(client.Call(models.AddressPool, "getTotalLiquidity--uint256")[0]).Mul(lib.ONE12)
+		var arbPrice, farmSupply, earnSupply *lib.BigInt
+		client.CallMethod(&arbPrice, models.OracleLatestAnswer, "0xb2A824043730FE05F3DA2efaFa1CBbe83fa548D6")
+		client.CallMethod(&farmSupply, models.FarmTvl, "0x72b9E266b4F531A5a41fE56D5B2ae1Bafba196c0")
+		client.CallMethod(&earnSupply, models.LendingPoolTotalLiquidity, models.AddressPool)
+		arbPrice = arbPrice.Mul(lib.ONE10)
+		earnSupply = earnSupply.Mul(lib.ONE12)
 		data.Farm = lib.Bn(10000, 18).Mul(arbPrice).Div(farmSupply)
 		data.Earn = lib.Bn(90000, 18).Mul(arbPrice).Div(earnSupply)
 		return data
@@ -382,13 +531,13 @@ func AppRewards(c *lib.Ctx) {
 		{"id": "8", "name": "Bulls: Season 1: Adjustment"},
 	}
 	indexes := []*big.Int{}
-	claimed := []*big.Int{}
+	claimed := []*lib.BigInt{}
 	for i := range weeks {
 		indexes = append(indexes, big.NewInt(int64(i)))
-		claimed = append(claimed, big.NewInt(0))
+		claimed = append(claimed, lib.ZERO)
 	}
 	if address != "" {
-		claimed = client.Call(models.AddressSTIPDistributor, "getClaimed-uint256[],address-uint256[]", indexes, address)[0].([]*big.Int)
+		client.CallMethod(&claimed, models.STIPDistributorGetClaimed, models.AddressSTIPDistributor, indexes, address)
 	}
 	for i, w := range weeks {
 		data := lib.J{}
@@ -396,7 +545,7 @@ func AppRewards(c *lib.Ctx) {
 		lib.Check(err)
 		lib.Check(json.Unmarshal(bs, &data))
 		w.Set("data", data)
-		w.Set("claimed", lib.Bnw(claimed[i]))
+		w.Set("claimed", claimed[i])
 		w.Set("claimable", lib.ZERO)
 		for _, u := range data["users"].([]interface{}) {
 			uu := u.(map[string]interface{})
@@ -415,47 +564,61 @@ func AppRewards(c *lib.Ctx) {
 	})
 }
 
+var vestingSourceNames = map[string]string{
+	"1": "xRDO Redeem",
+	"2": "Public Sale",
+	"3": "Private Round",
+	"4": "Private xRDO exits",
+	"5": "KOL",
+}
+
+// vestingsFor reads an address's vesting schedules, latest first
+func vestingsFor(ctx context.Context, client *lib.ChainClient, address string) ([]lib.J, error) {
+	vestings := []lib.J{}
+	var count *lib.BigInt
+	if err := client.CallMethodErr(ctx, &count, models.VesterSchedulesCount, models.AddressVester, address); err != nil {
+		return nil, err
+	}
+	schedules := models.VesterSchedules{}
+	infos := models.VesterSchedulesInfo{}
+	batch := client.Batch()
+	batch.CallMethod(&schedules, models.VesterGetSchedules, models.AddressVester, address, lib.ZERO, count)
+	batch.CallMethod(&infos, models.VesterGetSchedulesInfo, models.AddressVester, address, lib.ZERO, count)
+	if err := batch.RunErr(ctx); err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(schedules.Amounts); i++ {
+		amount := schedules.Amounts[i]
+		if amount.Eq(lib.ZERO) {
+			break
+		}
+		vesting := lib.J{
+			"index":     i,
+			"source":    vestingSourceNames[infos.Sources[i].String()],
+			"claimed":   schedules.Claimeds[i],
+			"amount":    amount,
+			"available": schedules.Availables[i],
+			"completed": amount.Eq(schedules.Claimeds[i]),
+			"start":     time.Unix(infos.Starts[i].Std().Int64(), 0),
+			"end":       time.Unix(infos.Starts[i].Add(infos.Times[i]).Std().Int64(), 0),
+		}
+		vestings = append([]lib.J{vesting}, vestings...)
+	}
+	return vestings, nil
+}
+
 func AppVesting(c *lib.Ctx) {
 	client := c.Server.ChainClients[models.DefaultChainId]
-	sourceNames := map[string]string{
-		"1": "xRDO Redeem",
-		"2": "Public Sale",
-		"3": "Private Round",
-		"4": "Private xRDO exits",
-		"5": "KOL",
-	}
 	tab := c.Param("tab", "active")
 	vestings := []lib.J{}
-	address := c.GetCookie("address")
-	if address != "" {
-		count := lib.Bni(client.Call(models.AddressVester, "schedulesCount-address-uint256", address)[0])
-		schedules := client.Call(models.AddressVester, "getSchedules-address,uint256,uint256-uint256[],uint256[],uint256[]", address, big.NewInt(0), count)
-		amounts := schedules[0].([]*big.Int)
-		claimeds := schedules[1].([]*big.Int)
-		availables := schedules[2].([]*big.Int)
-		infos := client.Call(models.AddressVester, "getSchedulesInfo-address,uint256,uint256-uint256[],address[],uint256[],uint256[],uint256[]", address, big.NewInt(0), count)
-		sources := infos[0].([]*big.Int)
-		times := infos[3].([]*big.Int)
-		starts := infos[4].([]*big.Int)
-		for i := 0; i < len(amounts); i++ {
-			if lib.Bnw(amounts[i]).Eq(lib.ZERO) {
-				break
-			}
-			done := lib.Bnw(amounts[i]).Eq(lib.Bnw(claimeds[i]))
-			if (tab == "active" && done) || (tab == "completed" && !done) {
+	if address := c.GetCookie("address"); address != "" {
+		all, err := vestingsFor(c.Context(), client, address)
+		chainFailed(c, err)
+		for _, v := range all {
+			if done := v["completed"].(bool); (tab == "active" && done) || (tab == "completed" && !done) {
 				continue
 			}
-
-			vesting := lib.J{
-				"index":     i,
-				"source":    sourceNames[sources[i].String()],
-				"claimed":   lib.Bnw(claimeds[i]),
-				"amount":    lib.Bnw(amounts[i]),
-				"available": lib.Bnw(availables[i]),
-				"start":     time.Unix(lib.Bnw(starts[i]).Std().Int64(), 0),
-				"end":       time.Unix(lib.Bnw(starts[i]).Add(lib.Bnw(times[i])).Std().Int64(), 0),
-			}
-			vestings = append([]lib.J{vesting}, vestings...)
+			vestings = append(vestings, v)
 		}
 	}
 	c.Render(200, "app/vesting", lib.J{
@@ -467,41 +630,61 @@ func AppVesting(c *lib.Ctx) {
 	})
 }
 
-func AppAnalytics(c *lib.Ctx) {
-	client := c.Server.ChainClients[models.DefaultChainId]
-	data := struct {
-		TokenPrice             *lib.BigInt
-		MarketCap              *lib.BigInt
-		MarketCapFullyDilluted *lib.BigInt
-		SupplyCirculating      *lib.BigInt
-		SupplyMax              *lib.BigInt
-		SupplyTotal            *lib.BigInt
-		SupplyPOL              *lib.BigInt
-		SupplyXrdo             *lib.BigInt
-		SupplyEcosystem        *lib.BigInt
-		SupplyPartners         *lib.BigInt
-		SupplyTeam             *lib.BigInt
-		SupplyMultisig         *lib.BigInt
-		SupplyDeployer         *lib.BigInt
-		Largest                []*models.Position
-		Profit                 []*models.Position
-		Danger                 []*models.Position
-	}{}
-	c.Cache.Try("analytics", &data, 15*time.Minute, func() interface{} {
-		data.TokenPrice = lib.Bni(client.Call("0x309349d5D02C6f8b50b5040e9128E1A8375042D7", "latestAnswer--int256")[0])
+type analyticsData struct {
+	TokenPrice             *lib.BigInt        `json:"tokenPrice"`
+	MarketCap              *lib.BigInt        `json:"marketCap"`
+	MarketCapFullyDilluted *lib.BigInt        `json:"marketCapFullyDilluted"`
+	SupplyCirculating      *lib.BigInt        `json:"supplyCirculating"`
+	SupplyMax              *lib.BigInt        `json:"supplyMax"`
+	SupplyTotal            *lib.BigInt        `json:"supplyTotal"`
+	SupplyPOL              *lib.BigInt        `json:"supplyPol"`
+	SupplyXrdo             *lib.BigInt        `json:"supplyXrdo"`
+	SupplyEcosystem        *lib.BigInt        `json:"supplyEcosystem"`
+	SupplyPartners         *lib.BigInt        `json:"supplyPartners"`
+	SupplyTeam             *lib.BigInt        `json:"supplyTeam"`
+	SupplyMultisig         *lib.BigInt        `json:"supplyMultisig"`
+	SupplyDeployer         *lib.BigInt        `json:"supplyDeployer"`
+	Largest                []*models.Position `json:"largest"`
+	Profit                 []*models.Position `json:"profit"`
+	Danger                 []*models.Position `json:"danger"`
+}
 
+// analyticsPositions returns the query ranking positions for one of the
+// analytics lists (largest, profit or danger), nil for an unknown one
+func analyticsPositions(db *lib.Database, list string) *lib.Query {
+	q := db.Query(&models.Position{})
+	switch list {
+	case "largest":
+		return q.OrderBy("shares_value desc")
+	case "profit":
+		return q.Where("amount > 0 and shares_value > 0").
+			OrderBy("((shares_value - ((borrow_value + amount) * price / 1e6)) * 1e18 / (amount * price / 1e6)) desc")
+	case "danger":
+		return q.Where("shares_value > 10e18 and life > 1e18").OrderBy("life asc")
+	}
+	return nil
+}
+
+func cacheAnalytics(c *lib.Ctx) func() interface{} {
+	return func() interface{} {
+		client := c.Server.ChainClients[models.DefaultChainId]
+		data := &analyticsData{}
+		batch := client.Batch()
+		var rdoInLp2, msOwnedLp2, lp2TotalSupply *lib.BigInt
+		batch.CallMethod(&data.TokenPrice, models.OracleLatestAnswer, "0x309349d5D02C6f8b50b5040e9128E1A8375042D7")
+		batch.CallMethod(&rdoInLp2, models.ERC20BalanceOf, models.AddressRdo, models.AddressLPToken2)
+		batch.CallMethod(&msOwnedLp2, models.ERC20BalanceOf, models.AddressLPToken2, models.AddressMultisigCamelot)
+		batch.CallMethod(&lp2TotalSupply, models.ERC20TotalSupply, models.AddressLPToken2)
+		batch.CallMethod(&data.SupplyXrdo, models.ERC20BalanceOf, models.AddressRdo, models.AddressXrdo)
+		batch.CallMethod(&data.SupplyTeam, models.ERC20BalanceOf, models.AddressRdo, models.AddressMultisigTeam)
+		batch.CallMethod(&data.SupplyEcosystem, models.ERC20BalanceOf, models.AddressRdo, "0x91E375808aD4DCE30461c852B3C64a6a13981d3C")
+		batch.CallMethod(&data.SupplyPartners, models.ERC20BalanceOf, models.AddressRdo, "0x6Bdee28E211BeD4cC0BEB6276A4dbbc108cb1878")
+		batch.CallMethod(&data.SupplyMultisig, models.ERC20BalanceOf, models.AddressRdo, models.AddressMultisig)
+		batch.CallMethod(&data.SupplyDeployer, models.ERC20BalanceOf, models.AddressRdo, "0x20dE070F1887f82fcE2bdCf5D6d9874091e6FAe9")
+		batch.CallMethod(&data.SupplyTotal, models.ERC20TotalSupply, models.AddressRdo)
+		batch.Run()
 		data.SupplyMax = lib.Bn(100_000_000, 18)
-		rdoInLp2 := lib.Bni(client.Call(models.AddressRdo, "balanceOf-address-uint256", models.AddressLPToken2)[0])
-		msOwnedLp2 := lib.Bni(client.Call(models.AddressLPToken2, "balanceOf-address-uint256", models.AddressMultisigCamelot)[0])
-		lp2TotalSupply := lib.Bni(client.Call(models.AddressLPToken2, "totalSupply--uint256")[0])
 		data.SupplyPOL = rdoInLp2.Mul(msOwnedLp2).Div(lp2TotalSupply)
-		data.SupplyXrdo = lib.Bni(client.Call(models.AddressRdo, "balanceOf-address-uint256", models.AddressXrdo)[0])
-		data.SupplyTeam = lib.Bni(client.Call(models.AddressRdo, "balanceOf-address-uint256", models.AddressMultisigTeam)[0])
-		data.SupplyEcosystem = lib.Bni(client.Call(models.AddressRdo, "balanceOf-address-uint256", "0x91E375808aD4DCE30461c852B3C64a6a13981d3C")[0])
-		data.SupplyPartners = lib.Bni(client.Call(models.AddressRdo, "balanceOf-address-uint256", "0x6Bdee28E211BeD4cC0BEB6276A4dbbc108cb1878")[0])
-		data.SupplyMultisig = lib.Bni(client.Call(models.AddressRdo, "balanceOf-address-uint256", models.AddressMultisig)[0])
-		data.SupplyDeployer = lib.Bni(client.Call(models.AddressRdo, "balanceOf-address-uint256", "0x20dE070F1887f82fcE2bdCf5D6d9874091e6FAe9")[0])
-		data.SupplyTotal = lib.Bni(client.Call(models.AddressRdo, "totalSupply--uint256")[0])
 		data.SupplyCirculating = data.SupplyTotal.
 			Sub(data.SupplyPOL).
 			Sub(data.SupplyXrdo).
@@ -513,11 +696,16 @@ func AppAnalytics(c *lib.Ctx) {
 		data.MarketCap = data.TokenPrice.Mul(data.SupplyCirculating).Div(lib.ONE)
 		data.MarketCapFullyDilluted = data.TokenPrice.Mul(data.SupplyTotal).Div(lib.ONE)
 
-		c.DB.AllWhere(&data.Largest, `1=1 order by shares_value desc limit 10`)
-		c.DB.AllWhere(&data.Profit, `amount > 0 and shares_value > 0 order by ((shares_value - ((borrow_value + amount) * price / 1e6)) * 1e18 / (amount * price / 1e6)) desc limit 10`)
-		c.DB.AllWhere(&data.Danger, `shares_value > 10e18 and life > 1e18 order by life asc limit 10`)
+		analyticsPositions(c.DB, "largest").Limit(10).All(&data.Largest)
+		analyticsPositions(c.DB, "profit").Limit(10).All(&data.Profit)
+		analyticsPositions(c.DB, "danger").Limit(10).All(&data.Danger)
 		return data
-	})
+	}
+}
+
+func AppAnalytics(c *lib.Ctx) {
+	data := analyticsData{}
+	c.Cache.Try("analytics", &data, 15*time.Minute, cacheAnalytics(c))
 	c.Render(200, "app/analytics", lib.J{
 		"title": "Analytics",
 		"data":  data,
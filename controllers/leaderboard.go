@@ -4,9 +4,19 @@ import (
 	"app/lib"
 	"app/models"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// leaderboardPageSize is how many rows each leaderboard tab shows at a time
+const leaderboardPageSize = 100
+
+func leaderboardPage(c *lib.Ctx) int64 {
+	page, _ := strconv.ParseInt(c.Param("page", "1"), 10, 64)
+	return page
+}
+
 func LeaderboardView(c *lib.Ctx) {
 	var u *models.LeaderboardUser
 	var joinedDiscord bool
@@ -40,15 +50,33 @@ func LeaderboardView(c *lib.Ctx) {
 	total := struct{ Total int64 }{}
 	c.DB.First(&total, "select sum(points) total from leaderboards_users")
 	tab := c.Param("tab", "leaderboard")
+	after := c.Param("after", "")
+	if parts := strings.SplitN(after, ",", 2); len(parts) != 2 || !isTime(parts[0]) {
+		// Not a cursor we made, start from the latest
+		after = ""
+	}
 	users := []*models.LeaderboardUser{}
 	points := []*models.LeaderboardPoint{}
 	referrals := []*models.LeaderboardUser{}
+	var page *lib.Page
 	if tab == "leaderboard" {
-		c.DB.All(&users, "select *, coalesce((select case when social_name = '' then address else social_name end from leaderboards_users u2 where u2.id = u1.referrer), '') as referrer from leaderboards_users u1 order by points desc limit 250")
+		page = c.DB.From("leaderboards_users u1").
+			Select("*, coalesce((select case when social_name = '' then address else social_name end from leaderboards_users u2 where u2.id = u1.referrer), '') as referrer").
+			OrderBy("points desc").OrderBy("created asc").
+			Paginate(&users, leaderboardPage(c), leaderboardPageSize)
 	} else if tab == "points" && address != "" {
-		c.DB.AllWhere(&points, "user_id = $1 order by created desc limit 250", u.ID)
+		// The ledger grows while it's browsed, so it's paged by time (then id for
+		// entries credited together) rather than offset
+		page = c.DB.Query(&points).Where("user_id = $1", u.ID).
+			PaginateAfter(&points, "created, id", true, after, leaderboardPageSize)
 	} else if tab == "referrals" && address != "" {
-		c.DB.AllWhere(&referrals, "referrer = $1 order by created desc limit 250", u.ID)
+		page = c.DB.Query(&referrals).Where("referrer = $1", u.ID).OrderBy("created desc").
+			Paginate(&referrals, leaderboardPage(c), leaderboardPageSize)
+	}
+
+	rankOffset := 0
+	if tab == "leaderboard" {
+		rankOffset = int((page.Page - 1) * page.Limit)
 	}
 
 	var userArb int64
@@ -62,6 +90,9 @@ func LeaderboardView(c *lib.Ctx) {
 		"total":         lib.Bn(total.Total, 0),
 		"userArb":       userArb,
 		"users":         users,
+		"page":          page,
+		"rankOffset":    rankOffset,
+		"after":         after,
 		"points":        points,
 		"referrals":     referrals,
 		"joinedDiscord": joinedDiscord,
@@ -141,3 +172,8 @@ func LeaderboardXAuth(c *lib.Ctx) {
 	models.LeaderboardPointCredit(c, user.ID, "X", user.SocialID, 100)
 	c.Redirect("/leaderboard/")
 }
+
+func isTime(s string) bool {
+	_, err := time.Parse(time.RFC3339Nano, s)
+	return err == nil
+}
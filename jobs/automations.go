@@ -3,6 +3,9 @@ package jobs
 import (
 	"app/lib"
 	"app/models"
+	"context"
+	"errors"
+	"fmt"
 	"math/big"
 	"net/url"
 	"time"
@@ -14,43 +17,49 @@ var automationContracts = []string{
 
 var _ = lib.RegisterSchedule("automations", time.Hour)
 
-var _ = lib.RegisterJob("automations", func(c *lib.Ctx, args lib.J) {
+// Sends txs from the keeper wallet, runs must never overlap nor be retried as a
+// failure after sending could resend them, the next scheduled run picks it up
+var _ = lib.RegisterJobOptions("automations", lib.JobOptions{Timeout: 30 * time.Minute, MaxAttempts: 1})
+
+var _ = lib.RegisterJob("automations", lib.Exclusive("automations", func(c *lib.Ctx, args lib.J) {
 	for _, contract := range automationContracts {
 		client := c.Server.ChainClients[models.DefaultChainId]
-		result := client.Call(contract, "canRun--bytes")
-		if len(result[0].([]byte)) == 0 {
+		var canRun []byte
+		client.CallMethod(&canRun, models.AutomationCanRun, contract)
+		if len(canRun) == 0 {
 			lib.LogInfo("skipping", lib.J{"contract": contract})
 			continue
 		}
 		lib.LogInfo("running", lib.J{"contract": contract})
-		txHash := client.Call(contract, "+run-bytes-", []byte{})[0].(string)
+		txHash := sendTx(c, client, args, "automations", models.AutomationRun, contract, []byte{})
 		lib.LogInfo("ran", lib.J{"contract": contract, "txhash": txHash})
 	}
-})
+}))
 
 var _ = lib.RegisterSchedule("automations-vaults", time.Hour)
+var _ = lib.RegisterJobOptions("automations-vaults", lib.JobOptions{Timeout: 30 * time.Minute, MaxAttempts: 1})
 
-var _ = lib.RegisterJob("automations-vaults", func(c *lib.Ctx, args lib.J) {
+var _ = lib.RegisterJob("automations-vaults", lib.Exclusive("automations-vaults", func(c *lib.Ctx, args lib.J) {
 	//oneInchRouter := "0x1111111254EEB25477B68fb85Ed929f73A960582"
 	wethAddress := "0x82aF49447D8a07e3bd95BD0d56f35241523fBab1"
 	for _, v := range models.Vaults {
 		client := c.Server.ChainClients[models.DefaultChainId]
-		result := client.Call(v.Strategy, "info--int256,uint256,uint256,uint256,uint256")
-		leverage := lib.Bni(result[1])
-		assets := lib.Bni(result[2])
-		balance := lib.Bni(result[3])
-		debt := lib.Bni(result[4])
-		result = client.Call(v.Asset, "balanceOf-address-uint256", v.Address)
-		assetsInVault := lib.Bni(result[0])
-		result = client.Call("0xb523AE262D20A936BC152e6023996e46FDC2A95D", "latestAnswer--int256")
-		wstEthToEthRate := lib.Bni(result[0])
+		info := models.VaultStrategyInfo{}
+		client.CallMethod(&info, models.VaultStrategyInfoGet, v.Strategy)
+		leverage := info.Leverage
+		assets := info.Assets
+		balance := info.Balance
+		debt := info.Debt
+		var assetsInVault, wstEthToEthRate *lib.BigInt
+		client.CallMethod(&assetsInVault, models.ERC20BalanceOf, v.Asset, v.Address)
+		client.CallMethod(&wstEthToEthRate, models.OracleLatestAnswer, "0xb523AE262D20A936BC152e6023996e46FDC2A95D")
 		deposits := assets.Add(assetsInVault)
 		reserve := deposits.Mul(lib.Bn(10, 0)).Div(lib.Bn(100, 0))
 		targetBorrow := deposits.Sub(reserve).Mul(v.TargetLeverage.Sub(lib.ONE)).Div(lib.ONE)
 		if leverage.Gt(v.TargetLeverage.Mul(lib.Bn(120, 0)).Div(lib.Bn(100, 0))) {
 			borrowChange := debt.Sub(targetBorrow.Mul(wstEthToEthRate).Div(lib.ONE))
-			result = client.Call(wethAddress, "balanceOf-address-uint256", v.Strategy)
-			wethInStrategy := lib.Bni(result[0])
+			var wethInStrategy *lib.BigInt
+			client.CallMethod(&wethInStrategy, models.ERC20BalanceOf, wethAddress, v.Strategy)
 
 			targetBalance := deposits.Mul(v.TargetLeverage).Div(lib.ONE).Sub(reserve)
 			wstethWithdraw := balance.Sub(targetBalance)
@@ -66,9 +75,8 @@ var _ = lib.RegisterJob("automations-vaults", func(c *lib.Ctx, args lib.J) {
 				"withdraw": wstethWithdraw.String(),
 				"repay":    borrowChange.String(),
 			})
-			txHash := client.Call(v.Strategy,
-				"+act-uint256,uint256,uint256,uint256,address,bytes-",
-				big.NewInt(2), swapAmount, borrowChange.Sub(wethInStrategy), swapAmount, swapTo, swapData)[0].(string)
+			txHash := sendTx(c, client, args, "automations-vaults", models.VaultStrategyAct, v.Strategy,
+				big.NewInt(2), swapAmount, borrowChange.Sub(wethInStrategy), swapAmount, swapTo, swapData)
 			lib.LogInfo("deleveraged", lib.J{
 				"vault":    v.Address,
 				"withdraw": wstethWithdraw.String(),
@@ -89,9 +97,8 @@ var _ = lib.RegisterJob("automations-vaults", func(c *lib.Ctx, args lib.J) {
 				"borrow": takeFromVault.String(),
 				"debt":   borrow.String(),
 			})
-			txHash := client.Call(v.Strategy,
-				"+act-uint256,uint256,uint256,uint256,address,bytes-",
-				big.NewInt(1), takeFromVault, borrow, borrow, swapTo, swapData)[0].(string)
+			txHash := sendTx(c, client, args, "automations-vaults", models.VaultStrategyAct, v.Strategy,
+				big.NewInt(1), takeFromVault, borrow, borrow, swapTo, swapData)
 			lib.LogInfo("leveraged", lib.J{
 				"vault":  v.Address,
 				"borrow": takeFromVault.String(),
@@ -100,7 +107,33 @@ var _ = lib.RegisterJob("automations-vaults", func(c *lib.Ctx, args lib.J) {
 			})
 		}
 	}
-})
+}))
+
+// sendTx sends a keeper tx and waits a bit for it to land so the job's logs tell
+// how it went (txs still pending after that are followed up by the chain-txs job).
+// With the `dry=1` job arg it's only simulated against pending state instead,
+// the summary printed and kept in app_simulations for review.
+func sendTx(c *lib.Ctx, client *lib.ChainClient, args lib.J, job string, method *lib.ContractMethod, to string, fnArgs ...interface{}) string {
+	if args.Get("dry") == "1" {
+		sim, err := client.Txs.SimulateMethod(c.Context(), job, method, to, fnArgs...)
+		lib.Check(err)
+		lib.Check(client.Txs.SaveSimulation(c.Context(), sim))
+		fmt.Print(sim.Summary())
+		return ""
+	}
+	lib.Check(c.CheckLock())
+	tx, err := client.Txs.SendMethod(c.Context(), method, to, fnArgs...)
+	lib.Check(err)
+	ctx, cancel := context.WithTimeout(c.Context(), 10*time.Minute)
+	defer cancel()
+	err = client.Txs.Wait(ctx, tx)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		lib.LogError("tx failed", lib.J{"txhash": tx.Hash, "label": tx.Label, "status": tx.Status, "error": err.Error()})
+	} else {
+		lib.LogInfo("tx "+tx.Status, lib.J{"txhash": tx.Hash, "label": tx.Label, "block": tx.BlockNumber})
+	}
+	return tx.Hash
+}
 
 func oneInchQuote(from, to, caller, amount string) (string, string) {
 	swap := struct {
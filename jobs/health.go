@@ -0,0 +1,134 @@
+package jobs
+
+import (
+	"app/lib"
+	"app/models"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// Life thresholds under which positions get to the warning and critical levels,
+// positions are liquidatable under 1
+var (
+	healthWarning  = healthThreshold("HEALTH_WARNING", 1.25)
+	healthCritical = healthThreshold("HEALTH_CRITICAL", 1.1)
+)
+
+func healthThreshold(name string, alt float64) *lib.BigInt {
+	value, err := strconv.ParseFloat(lib.Env(name, ""), 64)
+	if err != nil {
+		value = alt
+	}
+	return lib.Bnf(value, 18)
+}
+
+// healthLevel classifies a position by its life, positions without debt
+// can't be liquidated so they're ok whatever it is
+func healthLevel(p *models.Position) string {
+	life := p.Life
+	switch {
+	case p.Borrow == nil || p.Borrow.Eq(lib.ZERO):
+		return models.PositionHealthOk
+	case life.Lt(lib.ONE):
+		return models.PositionHealthLiquidatable
+	case life.Lt(healthCritical):
+		return models.PositionHealthCritical
+	case life.Lt(healthWarning):
+		return models.PositionHealthWarning
+	}
+	return models.PositionHealthOk
+}
+
+var _ = lib.RegisterSchedule("positions-health", 5*time.Minute)
+
+// Reads the life of every open position at the head (the Investor values them
+// against current oracle prices), and alerts when it crosses to another level
+var _ = lib.RegisterJob("positions-health", func(c *lib.Ctx, args lib.J) {
+	client := c.Server.ChainClients[models.DefaultChainId]
+	ids := []int64{}
+	c.DB.All(&ids, `select id from positions where chain = $1 and (shares > 0 or borrow > 0) order by id`, models.DefaultChainId)
+	healths := []*models.PositionHealth{}
+	c.DB.All(&healths, `select * from position_healths where chain = $1`, models.DefaultChainId)
+	previous := map[int64]*models.PositionHealth{}
+	for _, h := range healths {
+		previous[h.Id] = h
+	}
+	head, err := client.BlockNumberErr(c.Context())
+	lib.Check(err)
+
+	now := time.Now()
+	seen := map[int64]bool{}
+	for i := 0; i < len(ids); i += 100 {
+		bids := []*big.Int{}
+		for j := i; j < len(ids) && j < i+100; j++ {
+			bids = append(bids, big.NewInt(ids[j]))
+		}
+		for _, p := range snapshotPositions(c, client, int64(head), bids) {
+			if p.Shares.Eq(lib.ZERO) && p.Borrow.Eq(lib.ZERO) {
+				// Closed since last indexed, the indexer will record how
+				continue
+			}
+			seen[p.Id] = true
+			c.DB.Execute(`update positions set shares_value = $2, borrow_value = $3, life = coalesce($4, life), amount = $5, price = $6, updated = $7 where id = $1`,
+				p.Id, p.SharesValue, p.BorrowValue, p.Life, p.Amount, p.Price, now)
+			if p.Life == nil {
+				// Keep the last level till life can be read again
+				lib.Log("warning", "positions-health: life unreadable", lib.J{"id": p.Id})
+				continue
+			}
+
+			h := &models.PositionHealth{Id: p.Id, Chain: p.Chain, Index: p.Index, Owner: p.Owner, Level: healthLevel(p.Position), Life: p.Life, Updated: now}
+			c.DB.Execute(`insert into position_healths (id, chain, "index", owner, level, life, updated) values ($1, $2, $3, $4, $5, $6, $7)
+on conflict (id) do update set owner = $4, level = $5, life = $6, updated = $7`,
+				h.Id, h.Chain, h.Index, h.Owner, h.Level, h.Life, h.Updated)
+			last := previous[p.Id]
+			if last == nil {
+				last = &models.PositionHealth{Level: models.PositionHealthOk}
+			}
+			if last.Level != h.Level {
+				alertPositionHealth(c, p.Position, h, last.Level)
+			}
+		}
+	}
+	for id := range previous {
+		if !seen[id] {
+			c.DB.Execute(`delete from position_healths where id = $1`, id)
+		}
+	}
+})
+
+// alertPositionHealth records a level change and notifies about it. Getting
+// safer is only recorded, getting closer to liquidation is notified too.
+func alertPositionHealth(c *lib.Ctx, p *models.Position, h *models.PositionHealth, previous string) {
+	c.DB.Execute(`insert into position_alerts (chain, "index", owner, level, previous, life, created) values ($1, $2, $3, $4, $5, $6, $7)`,
+		h.Chain, h.Index, h.Owner, h.Level, previous, h.Life, h.Updated)
+	if h.Severity() <= models.PositionHealthSeverity(previous) {
+		return
+	}
+	level := "warning"
+	if h.Level != models.PositionHealthWarning {
+		level = "error"
+	}
+	err := c.Server.Notifier.Notify(c.Context(), &lib.Notification{
+		Level:   level,
+		Title:   fmt.Sprintf("Position #%d is %s", p.Index, h.Level),
+		Message: fmt.Sprintf("Life went from %s to %s (%s)", previous, h.Level, formatHealthUnits(h.Life)),
+		Address: p.Owner,
+		Fields: lib.J{
+			"position": p.Index,
+			"strategy": p.Strategy,
+			"life":     formatHealthUnits(h.Life),
+			"value":    formatHealthUnits(p.SharesValue),
+			"borrow":   formatHealthUnits(p.BorrowValue),
+		},
+	})
+	if err != nil {
+		lib.Log("error", "position health: notify", lib.J{"index": p.Index, "error": err.Error()})
+	}
+}
+
+func formatHealthUnits(n *lib.BigInt) string {
+	return fmt.Sprintf("%.2f", n.Float()/1e18)
+}
@@ -8,13 +8,18 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
 var _ = lib.RegisterSchedule("leaderboard", time.Hour)
 
+// RPC bound and slow, it gets its own queue so it doesn't hold up the others
+var _ = lib.RegisterJobOptions("leaderboard", lib.JobOptions{Queue: "slow", Concurrency: 1, Timeout: 50 * time.Minute})
+
 var _ = lib.RegisterJob("leaderboard-backfill", func(c *lib.Ctx, args lib.J) {
 
-	client := c.Server.ChainClients[models.DefaultChainId]
+	// Log queries span the whole history of the pool, give them more time than page reads
+	client := c.Server.ChainClients[models.DefaultChainId].WithTimeout(5 * time.Minute)
 
 	points := map[string]*lib.BigInt{}
 
@@ -66,13 +71,13 @@ var _ = lib.RegisterJob("leaderboard-backfill", func(c *lib.Ctx, args lib.J) {
 
 		// Farming
 		balances = map[string]*lib.BigInt{}
-		data := client.CallWithBlock(big.NewInt(int64(block)), "0x907F2323d58A7f0500EDefa0e146b4D1f38D865C", "get-uint256-address[],uint256[]", big.NewInt(3000))
-		positionBalances := data[1].([]*big.Int)
-		for i, a := range data[0].([]common.Address) {
+		data := models.FarmingBalances{}
+		client.CallMethodWithBlock(big.NewInt(int64(block)), &data, models.FarmingBalancesGet, "0x907F2323d58A7f0500EDefa0e146b4D1f38D865C", big.NewInt(3000))
+		for i, a := range data.Users {
 			if balances[a.Hex()] == nil {
 				balances[a.Hex()] = lib.ZERO
 			}
-			balances[a.Hex()] = balances[a.Hex()].Add(lib.Bnw(positionBalances[i]))
+			balances[a.Hex()] = balances[a.Hex()].Add(data.Balances[i])
 		}
 		credit(balances)
 	}
@@ -87,48 +92,60 @@ var _ = lib.RegisterJob("leaderboard-backfill", func(c *lib.Ctx, args lib.J) {
 	fmt.Printf("total,%s\n", total.String())
 })
 
-var _ = lib.RegisterJob("leaderboard", func(c *lib.Ctx, args lib.J) {
+var _ = lib.RegisterJob("leaderboard", lib.Exclusive("leaderboard", func(c *lib.Ctx, args lib.J) {
 	if time.Now().Unix() > 1711695600 {
 		return
 	}
 
 	client := c.Server.ChainClients[models.DefaultChainId]
 
-	// Lending
+	// Lending, only new pool transfers are fetched each run, balances are summed from the ones we kept
 	lm0 := "0x3A039A4125E8B8012CF3394eF7b8b02b739900b1"
 	lm1 := "0x3aEe6cA602C060883201B89c64cb5F782F964879"
-	logs := client.FilterLogs(models.AddressPool, []string{"0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"})
-	balances := map[string]*lib.BigInt{}
-	for _, l := range logs {
-		inp := common.HexToAddress("0x" + l.Topics[1].Hex()[26:]).Hex()
-		out := common.HexToAddress("0x" + l.Topics[2].Hex()[26:]).Hex()
-		amount := lib.Bnw(new(big.Int).SetBytes(l.Data)).Mul(lib.Bn(107, 10))
-		if inp == lm0 || out == lm0 || inp == lm1 || out == lm1 {
-			continue
-		}
-		if balances[inp] == nil {
-			balances[inp] = lib.ZERO
-		}
-		if balances[out] == nil {
-			balances[out] = lib.ZERO
+	scanner := lib.NewLogScanner(c.DB, client, 39117212, []string{models.AddressPool}, []string{"0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"})
+	lib.Check(scanner.Scan(c.Context(), func(logs []types.Log, from, to int64) error {
+		for _, l := range logs {
+			inp := common.HexToAddress("0x" + l.Topics[1].Hex()[26:]).Hex()
+			out := common.HexToAddress("0x" + l.Topics[2].Hex()[26:]).Hex()
+			if inp == lm0 || out == lm0 || inp == lm1 || out == lm1 {
+				continue
+			}
+			err := c.DB.ExecuteErr(`insert into leaderboards_transfers (block, log_index, sender, receiver, amount) values ($1, $2, $3, $4, $5) on conflict do nothing`,
+				l.BlockNumber, l.Index, inp, out, lib.Bnw(new(big.Int).SetBytes(l.Data)))
+			if err != nil {
+				return err
+			}
 		}
-		balances[inp] = balances[inp].Sub(amount)
-		balances[out] = balances[out].Add(amount)
+		return nil
+	}, func(from int64) error {
+		return c.DB.ExecuteErr(`delete from leaderboards_transfers where block >= $1`, from)
+	}))
+	rows := []struct {
+		Address string
+		Balance *lib.BigInt
+	}{}
+	c.DB.All(&rows, `select address, sum(amount) as balance from (
+  select receiver as address, amount from leaderboards_transfers
+  union all select sender as address, -amount from leaderboards_transfers
+) t group by address`)
+	balances := map[string]*lib.BigInt{}
+	for _, r := range rows {
+		balances[r.Address] = r.Balance.Mul(lib.Bn(107, 10))
 	}
 	cleanAndCredit(c, client, balances, "Lending")
 
 	// Farming
 	balances = map[string]*lib.BigInt{}
-	data := client.Call("0x907F2323d58A7f0500EDefa0e146b4D1f38D865C", "get-uint256-address[],uint256[]", big.NewInt(3000))
-	positionBalances := data[1].([]*big.Int)
-	for i, a := range data[0].([]common.Address) {
+	data := models.FarmingBalances{}
+	client.CallMethod(&data, models.FarmingBalancesGet, "0x907F2323d58A7f0500EDefa0e146b4D1f38D865C", big.NewInt(3000))
+	for i, a := range data.Users {
 		if balances[a.Hex()] == nil {
 			balances[a.Hex()] = lib.ZERO
 		}
-		balances[a.Hex()] = balances[a.Hex()].Add(lib.Bnw(positionBalances[i]))
+		balances[a.Hex()] = balances[a.Hex()].Add(data.Balances[i])
 	}
 	cleanAndCredit(c, client, balances, "Farming")
-})
+}))
 
 func cleanAndCredit(c *lib.Ctx, client *lib.ChainClient, balances map[string]*lib.BigInt, action string) {
 	// Clean
@@ -140,10 +157,13 @@ func cleanAndCredit(c *lib.Ctx, client *lib.ChainClient, balances map[string]*li
 	}
 
 	// xRDO Balances
-	rdoPrice := client.CallUint("0x309349d5D02C6f8b50b5040e9128E1A8375042D7", "latestAnswer--int256")
+	var rdoPrice *lib.BigInt
+	client.CallMethod(&rdoPrice, models.OracleLatestAnswer, "0x309349d5D02C6f8b50b5040e9128E1A8375042D7")
 	xrdoBalances := map[string]*lib.BigInt{}
 	for k := range balances {
-		xrdoBalances[k] = client.CallUint(models.AddressXrdo, "balanceOf-address-uint256", k).Mul(rdoPrice).Div(lib.ONE)
+		var balance *lib.BigInt
+		client.CallMethod(&balance, models.ERC20BalanceOf, models.AddressXrdo, k)
+		xrdoBalances[k] = balance.Mul(rdoPrice).Div(lib.ONE)
 	}
 
 	for k, v := range balances {
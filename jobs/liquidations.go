@@ -0,0 +1,155 @@
+package jobs
+
+import (
+	"app/lib"
+	"app/models"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+var _ = lib.RegisterSchedule("positions-liquidate", time.Minute)
+var _ = lib.RegisterJobOptions("positions-liquidate", lib.JobOptions{Timeout: 10 * time.Minute, MaxAttempts: 1})
+
+// Kills liquidatable positions with the keeper wallet, which needs a balance of
+// the pool asset and to have approved the Investor to repay their borrow.
+// Candidates are simulated against current state and ranked by the kill fee
+// left after gas, at most `max` (LIQUIDATE_MAX) are sent per run. Positions or
+// owners in `deny` (LIQUIDATE_DENY, comma separated) are never killed, and
+// with `dry=1` the simulations are only printed. Simulations are kept in
+// app_simulations for the kills sent and for every candidate of dry runs.
+var _ = lib.RegisterJob("positions-liquidate", lib.Exclusive("positions-liquidate", func(c *lib.Ctx, args lib.J) {
+	client := c.Server.ChainClients[models.DefaultChainId]
+	pool := models.Pools[0]
+	maxKills := lib.StringToInt(lib.Env("LIQUIDATE_MAX", "3"))
+	if args.Get("max") != "" {
+		maxKills = lib.StringToInt(args.Get("max"))
+	}
+	deny := map[string]bool{}
+	for _, d := range strings.Split(lib.Env("LIQUIDATE_DENY", "")+","+args.Get("deny"), ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			deny[d] = true
+		}
+	}
+
+	positions := []*models.Position{}
+	c.DB.All(&positions, `select * from positions where chain = $1 and borrow > 0 order by id`, models.DefaultChainId)
+	lifes := make([]*lib.BigInt, len(positions))
+	for i := 0; i < len(positions); i += 200 {
+		batch := client.Batch()
+		for j := i; j < len(positions) && j < i+200; j++ {
+			batch.TryCallMethod(&lifes[j], models.InvestorLife, models.AddressInvestor, big.NewInt(positions[j].Index))
+		}
+		lib.Check(batch.RunErr(c.Context()))
+	}
+	candidates := []*liquidationCandidate{}
+	for i, p := range positions {
+		if lifes[i] == nil || !lifes[i].Lt(lib.ONE) {
+			continue
+		}
+		if deny[fmt.Sprint(p.Index)] || deny[strings.ToLower(p.Owner)] {
+			lib.LogInfo("liquidation denied", lib.J{"index": p.Index, "owner": p.Owner})
+			continue
+		}
+		candidates = append(candidates, &liquidationCandidate{position: p, life: lifes[i]})
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	var padding, balance, allowance, ethPrice *lib.BigInt
+	batch := client.Batch()
+	for _, l := range candidates {
+		batch.CallMethod(&l.repayment, models.InvestorKillRepayment, models.AddressInvestor, big.NewInt(l.position.Index))
+	}
+	batch.CallMethod(&padding, models.InvestorKillCollateralPadding, models.AddressInvestor)
+	batch.CallMethod(&balance, models.ERC20BalanceOf, pool.Asset, client.WalletAddress.String())
+	batch.CallMethod(&allowance, models.ERC20Allowance, pool.Asset, client.WalletAddress.String(), models.AddressInvestor)
+	batch.CallMethod(&ethPrice, models.OracleLatestAnswer, models.Tokens["0x82aF49447D8a07e3bd95BD0d56f35241523fBab1"].Oracle)
+	lib.Check(batch.RunErr(c.Context()))
+	tip, feeCap, err := client.Txs.SuggestFees(c.Context())
+	lib.Check(err)
+	gasPrice := feeCap.Add(tip).Div(lib.Bn(2, 0))
+
+	for _, l := range candidates {
+		// killRepayment is borrow plus half the padding, the liquidator gets the
+		// repayment plus the other half back in collateral and strategy assets
+		l.fee = l.repayment.Mul(padding).Div(lib.Bn(20000, 0).Add(padding))
+		l.sim, err = client.Txs.SimulateMethod(c.Context(), "positions-liquidate", models.InvestorKill, models.AddressInvestor, big.NewInt(l.position.Index))
+		lib.Check(err)
+		gasCost := lib.Bn(l.sim.Gas, 0).Mul(gasPrice).Mul(ethPrice).Div(lib.Bn(1, 8))
+		l.profit = l.fee.Mul(lib.ONE12).Sub(gasCost)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].profit.Gt(candidates[j].profit) })
+
+	kills := []*liquidationCandidate{}
+	for _, l := range candidates {
+		fields := lib.J{"index": l.position.Index, "life": l.life.String(), "repayment": l.repayment.String(), "profit": formatHealthUnits(l.profit)}
+		switch {
+		case !l.sim.Success:
+			fields["revert"] = l.sim.Revert
+			lib.LogInfo("liquidation skipped: kill reverts", fields)
+		case l.profit.Lte(lib.ZERO):
+			lib.LogInfo("liquidation skipped: unprofitable", fields)
+		case l.repayment.Gt(balance) || l.repayment.Gt(allowance):
+			lib.LogError("liquidation skipped: not enough balance or allowance to repay", fields)
+		case int64(len(kills)) >= maxKills:
+			lib.LogInfo("liquidation skipped: max per run reached", fields)
+		default:
+			balance = balance.Sub(l.repayment)
+			allowance = allowance.Sub(l.repayment)
+			kills = append(kills, l)
+		}
+	}
+
+	if args.Get("dry") == "1" {
+		for _, l := range candidates {
+			lib.Check(client.Txs.SaveSimulation(c.Context(), l.sim))
+		}
+		for _, l := range kills {
+			fmt.Printf("profit $%s\n%s", formatHealthUnits(l.profit), l.sim.Summary())
+		}
+		return
+	}
+	txs := []*lib.ChainTx{}
+	for _, l := range kills {
+		if err := c.CheckLock(); err != nil {
+			lib.LogError("liquidations stopped: lock lost", lib.J{"index": l.position.Index, "error": err.Error()})
+			break
+		}
+		// Only the simulations of kills are kept, not every candidate's every minute
+		if err := client.Txs.SaveSimulation(c.Context(), l.sim); err != nil {
+			lib.LogError("liquidation simulation not saved", lib.J{"index": l.position.Index, "error": err.Error()})
+		}
+		tx, err := client.Txs.SendMethod(c.Context(), models.InvestorKill, models.AddressInvestor, big.NewInt(l.position.Index))
+		if err != nil {
+			lib.LogError("liquidation failed", lib.J{"index": l.position.Index, "error": err.Error()})
+			continue
+		}
+		lib.LogInfo("liquidating", lib.J{"index": l.position.Index, "profit": formatHealthUnits(l.profit), "txhash": tx.Hash})
+		txs = append(txs, tx)
+	}
+	ctx, cancel := context.WithTimeout(c.Context(), 5*time.Minute)
+	defer cancel()
+	for _, tx := range txs {
+		err := client.Txs.Wait(ctx, tx)
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			lib.LogError("liquidation tx failed", lib.J{"txhash": tx.Hash, "status": tx.Status, "error": err.Error()})
+		} else {
+			lib.LogInfo("liquidation tx "+tx.Status, lib.J{"txhash": tx.Hash, "block": tx.BlockNumber})
+		}
+	}
+}))
+
+type liquidationCandidate struct {
+	position  *models.Position
+	life      *lib.BigInt
+	repayment *lib.BigInt
+	fee       *lib.BigInt
+	profit    *lib.BigInt
+	sim       *lib.ChainSimulation
+}
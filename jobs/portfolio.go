@@ -0,0 +1,33 @@
+package jobs
+
+import (
+	"app/lib"
+	"app/models"
+	"math/big"
+	"time"
+)
+
+var _ = lib.RegisterSchedule("positions-snapshot", time.Hour)
+
+// Records the state of open positions in their history between events, so
+// portfolios can tell how their value and interest evolved day by day
+var _ = lib.RegisterJob("positions-snapshot", func(c *lib.Ctx, args lib.J) {
+	client := c.Server.ChainClients[models.DefaultChainId]
+	ids := []int64{}
+	c.DB.All(&ids, `select id from positions where chain = $1 and (shares > 0 or borrow > 0) order by id`, models.DefaultChainId)
+	head, err := client.BlockNumberErr(c.Context())
+	lib.Check(err)
+	now := time.Now()
+	for i := 0; i < len(ids); i += 100 {
+		bids := []*big.Int{}
+		for j := i; j < len(ids) && j < i+100; j++ {
+			bids = append(bids, big.NewInt(ids[j]))
+		}
+		for _, p := range snapshotPositions(c, client, int64(head), bids) {
+			keepPositionLife(c, p.Position)
+			c.DB.Execute(`insert into position_histories (chain, "index", time, shares, borrow, shares_value, borrow_value, life, amount, price, event, block, log_index, collateral_value, flow, fee)
+values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 'snapshot', $11, -1, $12, 0, 0) on conflict (chain, block, log_index, "index") do nothing`,
+				p.Chain, p.Index, now, p.Shares, p.Borrow, p.SharesValue, p.BorrowValue, p.Life, p.Amount, p.Price, head, p.CollateralValue)
+		}
+	}
+})
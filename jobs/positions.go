@@ -0,0 +1,316 @@
+package jobs
+
+import (
+	"app/lib"
+	"app/models"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var positionEvents = map[common.Hash]string{
+	crypto.Keccak256Hash([]byte("Open(uint256,uint256,uint256,uint256,address)")):                "open",
+	crypto.Keccak256Hash([]byte("Edit(uint256,int256,int256)")):                                  "edit",
+	crypto.Keccak256Hash([]byte("Kill(uint256,uint256,uint256,uint256,uint256,uint256)")):        "kill",
+	crypto.Keccak256Hash([]byte("PartialKill(uint256,uint256,uint256,uint256,uint256,uint256)")): "partial-kill",
+	crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)")):                            "transfer",
+}
+
+// Block the Investor was deployed at
+var positionsStartBlock int64 = 39117212
+
+var _ = lib.RegisterSchedule("positions-index", time.Minute)
+var _ = lib.RegisterJobOptions("positions-index", lib.JobOptions{Concurrency: 1, Timeout: 10 * time.Minute})
+
+var _ = lib.RegisterJob("positions-index", func(c *lib.Ctx, args lib.J) {
+	client := c.Server.ChainClients[models.DefaultChainId]
+	topics := []string{}
+	for t := range positionEvents {
+		topics = append(topics, t.Hex())
+	}
+	scanner := lib.NewLogScanner(c.DB, client, positionsStartBlock, []string{models.AddressInvestor, models.AddressPositionManager}, topics)
+	scanner.ID = "positions"
+	// Cap the work done per run, the schedule picks it back up
+	scanner.MaxPages = 10
+	lib.Check(scanner.Scan(c.Context(), func(logs []types.Log, from, to int64) error {
+		indexPositionLogs(c, client, logs)
+		return nil
+	}, func(from int64) error {
+		// Drop the history built on orphaned blocks, and bring the positions it
+		// touched back to their current state as the new blocks may not touch them
+		ids := []int64{}
+		c.DB.All(&ids, `select distinct "index" from position_histories where chain = $1 and block >= $2`, models.DefaultChainId, from)
+		c.DB.Execute(`delete from position_histories where chain = $1 and block >= $2`, models.DefaultChainId, from)
+		if len(ids) == 0 {
+			return nil
+		}
+		head, err := client.BlockNumberErr(c.Context())
+		if err != nil {
+			return err
+		}
+		bids := []*big.Int{}
+		for _, id := range ids {
+			bids = append(bids, big.NewInt(id))
+		}
+		for _, p := range snapshotPositions(c, client, int64(head), bids) {
+			keepPositionLife(c, p.Position)
+			c.DB.Put(p.Position)
+		}
+		return nil
+	}))
+})
+
+type positionEvent struct {
+	id       *big.Int
+	name     string
+	logIndex int64
+	data     []byte
+}
+
+func indexPositionLogs(c *lib.Ctx, client *lib.ChainClient, logs []types.Log) {
+	blocks := map[uint64][]positionEvent{}
+	for _, l := range logs {
+		name := positionEvents[l.Topics[0]]
+		if l.Removed || name == "" {
+			continue
+		}
+		// Transfer is the only event we want from the PositionManager, and the only one it has the id of as 3rd topic
+		isManager := l.Address == common.HexToAddress(models.AddressPositionManager)
+		if isManager != (name == "transfer") {
+			continue
+		}
+		idTopic := 1
+		if name == "transfer" {
+			idTopic = 3
+		}
+		if len(l.Topics) <= idTopic {
+			continue
+		}
+		blocks[l.BlockNumber] = append(blocks[l.BlockNumber], positionEvent{
+			id:       l.Topics[idTopic].Big(),
+			name:     name,
+			logIndex: int64(l.Index),
+			data:     l.Data,
+		})
+	}
+
+	numbers := []uint64{}
+	for n := range blocks {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	for _, n := range numbers {
+		ids := []*big.Int{}
+		seen := map[string]bool{}
+		for _, e := range blocks[n] {
+			if !seen[e.id.String()] {
+				seen[e.id.String()] = true
+				ids = append(ids, e.id)
+			}
+		}
+		header, err := client.HeaderErr(c.Context(), new(big.Int).SetUint64(n))
+		lib.Check(err)
+		blockTime := time.Unix(int64(header.Time), 0)
+		positions := snapshotPositions(c, client, int64(n), ids)
+		for _, p := range positions {
+			p.Updated = blockTime
+			if p.Created.Unix() == 0 {
+				// Closed positions are zeroed out on chain, keep the date they were opened at
+				existing := &models.Position{}
+				err := c.DB.MustFirstWhereErr(existing, "id = $1", p.Id)
+				if err == lib.ErrDatabaseNotFound {
+					p.Created = blockTime
+				} else {
+					lib.Check(err)
+					p.Created = existing.Created
+				}
+			}
+			keepPositionLife(c, p.Position)
+			c.DB.Put(p.Position)
+		}
+		// Edits need the state before them to tell how much was taken out
+		edited := []*big.Int{}
+		for _, e := range blocks[n] {
+			if e.name == "edit" {
+				edited = append(edited, e.id)
+			}
+		}
+		before := map[string]*positionSnapshot{}
+		if len(edited) > 0 {
+			before = snapshotPositions(c, client, int64(n)-1, edited)
+		}
+		for _, e := range blocks[n] {
+			p := positions[e.id.String()]
+			flow, fee := positionFlow(c, client, int64(n), e, before[e.id.String()], p)
+			c.DB.Execute(`insert into position_histories (chain, "index", time, shares, borrow, shares_value, borrow_value, life, amount, price, event, block, log_index, collateral_value, flow, fee)
+values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) on conflict (chain, block, log_index, "index") do nothing`,
+				p.Chain, p.Index, blockTime, p.Shares, p.Borrow, p.SharesValue, p.BorrowValue, p.Life, p.Amount, p.Price, e.name, n, e.logIndex,
+				p.CollateralValue, flow, fee)
+		}
+	}
+}
+
+// positionFlow values what an event moved between a position and its owner (positive
+// for deposits, negative for withdrawals) and the fees it cost them, in USD with 18
+// decimals. Opens deposit the collateral. Edits move collateral, and when selling
+// shares the owner gets what left the position minus the performance fee (as of
+// the event's block). Kills cost the liquidator's fee, paid twice over (half to
+// the protocol).
+func positionFlow(c *lib.Ctx, client *lib.ChainClient, block int64, e positionEvent, before, after *positionSnapshot) (*lib.BigInt, *lib.BigInt) {
+	switch e.name {
+	case "open":
+		return after.CollateralValue, lib.ZERO
+	case "kill", "partial-kill":
+		if len(e.data) < 5*32 {
+			return lib.ZERO, lib.ZERO
+		}
+		fee := lib.Bnw(new(big.Int).SetBytes(e.data[4*32 : 5*32]))
+		return lib.ZERO, fee.Mul(lib.Bn(2, 0)).Mul(lib.ONE12)
+	case "edit":
+		if before == nil || len(e.data) < 2*32 {
+			return lib.ZERO, lib.ZERO
+		}
+		borrow := math.S256(new(big.Int).SetBytes(e.data[0:32]))
+		collateral := math.S256(new(big.Int).SetBytes(e.data[32:64]))
+		// Value the collateral moved at the price it has on either side of the edit
+		flow := lib.ZERO
+		for _, p := range []*positionSnapshot{after, before} {
+			if p.Collateral.Gt(lib.ZERO) {
+				flow = lib.Bnw(collateral).Mul(p.CollateralValue).Div(p.Collateral)
+				break
+			}
+		}
+		fee := lib.ZERO
+		if borrow.Sign() < 0 {
+			equity := func(p *positionSnapshot) *lib.BigInt {
+				return p.SharesValue.Add(p.CollateralValue).Sub(p.BorrowValue.Mul(lib.ONE12))
+			}
+			out := equity(before).Sub(equity(after)).Add(flow)
+			if out.Gt(lib.ZERO) {
+				var performanceFee *lib.BigInt
+				lib.Check(client.CallMethodWithBlockErr(c.Context(), big.NewInt(block), &performanceFee, models.InvestorPerformanceFee, models.AddressInvestor))
+				fee = out.Mul(performanceFee).Div(lib.Bn(10000, 0))
+				flow = flow.Sub(out.Sub(fee))
+			}
+		}
+		return flow, fee
+	}
+	return lib.ZERO, lib.ZERO
+}
+
+// keepPositionLife fills in the life of a snapshot that couldn't read it with
+// the last one stored, 1 for a position not stored yet
+func keepPositionLife(c *lib.Ctx, p *models.Position) {
+	if p.Life != nil {
+		return
+	}
+	lives := []*lib.BigInt{}
+	c.DB.All(&lives, `select life from positions where id = $1`, p.Id)
+	p.Life = lib.ONE
+	if len(lives) > 0 {
+		p.Life = lives[0]
+	}
+	lib.Log("warning", "positions: life unreadable, keeping last", lib.J{"id": p.Id, "life": p.Life.String()})
+}
+
+// positionSnapshot is a position as read at a block, with the value of its
+// collateral (USD, 18 decimals) which positions don't store
+type positionSnapshot struct {
+	*models.Position
+	CollateralValue *lib.BigInt
+}
+
+// snapshotPositions reads the state of positions as of the end of a block. Their
+// SharesValue and Amount mean what they do on the farm page (the strategy shares'
+// value and the position's basis), the collateral is valued apart.
+func snapshotPositions(c *lib.Ctx, client *lib.ChainClient, block int64, ids []*big.Int) map[string]*positionSnapshot {
+	pool := models.Pools[0]
+	batch := client.BatchWithBlock(big.NewInt(block))
+	investorPositions := make([]models.InvestorPosition, len(ids))
+	lifes := make([]*lib.BigInt, len(ids))
+	owners := make([]common.Address, len(ids))
+	for i, id := range ids {
+		batch.CallMethod(&investorPositions[i], models.InvestorGetPosition, models.AddressInvestor, id)
+		// life reverts for closed positions and ownerOf for burned ones
+		batch.TryCallMethod(&lifes[i], models.InvestorLife, models.AddressInvestor, id)
+		batch.TryCallMethod(&owners[i], models.PositionManagerOwnerOf, models.AddressPositionManager, id)
+	}
+	poolInfo := models.HelperPool{}
+	batch.CallMethod(&poolInfo, models.HelperPoolInfo, models.AddressHelper, pool.Address)
+	lib.Check(batch.RunErr(c.Context()))
+	poolIndex := poolInfo.Index
+	poolPrice := poolInfo.Price
+
+	// Values need the strategy rates and collateral prices at that block
+	batch = client.BatchWithBlock(big.NewInt(block))
+	rates := make([]*lib.BigInt, len(ids))
+	for i, p := range investorPositions {
+		rates[i] = lib.ZERO
+		if p.Shares == nil || p.Shares.Eq(lib.ZERO) {
+			continue
+		}
+		for _, s := range models.Strategies {
+			if s.Index == p.Strategy.Std().Int64() {
+				batch.TryCallMethod(&rates[i], models.StrategyRate, s.Address, p.Shares)
+			}
+		}
+	}
+	type oraclePrice struct {
+		decimals uint8
+		answer   *lib.BigInt
+	}
+	prices := map[string]*oraclePrice{}
+	for _, p := range investorPositions {
+		token := models.Tokens[p.Token.String()]
+		if token == nil || prices[token.Address] != nil {
+			continue
+		}
+		price := &oraclePrice{answer: lib.ZERO}
+		batch.TryCallMethod(&price.decimals, models.OracleDecimals, token.Oracle)
+		batch.TryCallMethod(&price.answer, models.OracleLatestAnswer, token.Oracle)
+		prices[token.Address] = price
+	}
+	lib.Check(batch.RunErr(c.Context()))
+
+	positions := map[string]*positionSnapshot{}
+	for i, id := range ids {
+		ip := investorPositions[i]
+		p := &models.Position{
+			Id:          id.Int64(),
+			Chain:       models.DefaultChainId,
+			Index:       id.Int64(),
+			Pool:        pool.Address,
+			Strategy:    ip.Strategy.Std().Int64(),
+			Owner:       owners[i].String(),
+			Token:       ip.Token.String(),
+			Collateral:  ip.Collateral,
+			Shares:      ip.Shares,
+			Borrow:      ip.Borrow,
+			BorrowValue: ip.Borrow.Mul(poolIndex).Div(lib.ONE),
+			Amount:      ip.Basis,
+			Price:       poolPrice,
+			Created:     time.Unix(ip.Start.Std().Int64(), 0),
+		}
+		// life is exactly 1 without debt (it reverts once closed). When it can't
+		// be read for a borrowing position it's left nil rather than made up.
+		if lifes[i] != nil {
+			p.Life = lifes[i]
+		} else if ip.Borrow == nil || ip.Borrow.Eq(lib.ZERO) {
+			p.Life = lib.ONE
+		}
+		collateralValue := lib.ZERO
+		if token := models.Tokens[p.Token]; token != nil && prices[token.Address].decimals > 0 {
+			oracle := prices[token.Address]
+			price := oracle.answer.Mul(lib.ONE).Div(lib.Bn(1, int64(oracle.decimals)))
+			collateralValue = p.Collateral.Mul(price).Div(lib.Bn(1, token.Decimals))
+		}
+		p.SharesValue = rates[i]
+		positions[id.String()] = &positionSnapshot{Position: p, CollateralValue: collateralValue}
+	}
+	return positions
+}
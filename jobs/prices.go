@@ -0,0 +1,34 @@
+package jobs
+
+import (
+	"app/lib"
+	"app/models"
+	"time"
+)
+
+var _ = lib.RegisterSchedule("prices-sample", 5*time.Minute)
+
+// Samples every price feed into prices, scaled to 18 decimals, so pages and
+// jobs can look prices up over time without archive node calls
+var _ = lib.RegisterJob("prices-sample", func(c *lib.Ctx, args lib.J) {
+	client := c.Server.ChainClients[models.DefaultChainId]
+	decimals := make([]uint8, len(models.PriceFeeds))
+	answers := make([]*lib.BigInt, len(models.PriceFeeds))
+	batch := client.Batch()
+	for i, f := range models.PriceFeeds {
+		// Feeds without decimals() answer with 18
+		decimals[i] = 18
+		batch.TryCallMethod(&decimals[i], models.OracleDecimals, f.Oracle)
+		batch.TryCallMethod(&answers[i], models.OracleLatestAnswer, f.Oracle)
+	}
+	lib.Check(batch.RunErr(c.Context()))
+	now := time.Now().Truncate(time.Minute)
+	for i, f := range models.PriceFeeds {
+		if answers[i] == nil || answers[i].Lte(lib.ZERO) {
+			lib.LogError("price feed failed", lib.J{"asset": f.Asset, "oracle": f.Oracle})
+			continue
+		}
+		price := answers[i].Mul(lib.ONE).Div(lib.Bn(1, int64(decimals[i])))
+		c.DB.Execute(`insert into prices (id, price, time) values ($1, $2, $3) on conflict (id, time) do nothing`, f.Asset, price, now)
+	}
+})
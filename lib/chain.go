@@ -2,20 +2,18 @@ package lib
 
 import (
 	"context"
-	"crypto/ecdsa"
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"math/big"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 )
 
@@ -149,34 +147,133 @@ func Bni(b interface{}) *BigInt {
 }
 
 type ChainClient struct {
-	Client        *ethclient.Client
-	ChainID       *big.Int
+	ChainID *big.Int
+	// WalletAddress is the Signer's address, zero when there is no signer
 	WalletAddress common.Address
-	WalletKey     *ecdsa.PrivateKey
+	// Signer signs write transactions, nil for processes that only read
+	Signer Signer
+	// Timeout bounds every RPC call made through the `...Err` methods (and the ones
+	// wrapping them), per endpoint tried
+	Timeout time.Duration
+	// Txs sends the write calls, set by NewTxManager
+	Txs *TxManager
+
+	endpoints []*ChainEndpoint
+	strategy  string
+	next      uint64
 }
 
+// NewChainClient connects to the comma separated list of endpoints in RPC_URL_<chainId>.
+// Calls go to the fastest healthy endpoint (or rotate when RPC_STRATEGY=round-robin)
+// and fail over to the next one on transport errors.
 func NewChainClient(chainId int64) *ChainClient {
-	var err error
 	c := &ChainClient{}
 	c.ChainID = big.NewInt(chainId)
-	c.Client, err = ethclient.Dial(Env("RPC_URL_"+strconv.FormatInt(chainId, 10), "https://arb1.arbitrum.io/rpc"))
-	Check(err)
-	c.WalletKey = crypto.ToECDSAUnsafe(common.FromHex(Env("PRIVATE_KEY", "")))
-	c.WalletAddress = crypto.PubkeyToAddress(c.WalletKey.PublicKey)
+	c.Timeout = time.Duration(StringToInt(Env("RPC_TIMEOUT_MS", "10000"))) * time.Millisecond
+	c.strategy = Env("RPC_STRATEGY", "latency")
+	c.endpoints = parseChainEndpoints(Env("RPC_URL_"+strconv.FormatInt(chainId, 10), "https://arb1.arbitrum.io/rpc"))
+	if len(c.endpoints) == 0 {
+		panic(fmt.Errorf("NewChainClient: no RPC endpoints for chain %d", chainId))
+	}
+	if len(c.endpoints) > 1 {
+		go c.monitor()
+	}
+	c.Signer = NewSignerFromEnv()
+	if c.Signer != nil {
+		c.WalletAddress = c.Signer.Address()
+	}
 	return c
 }
 
+// WithTimeout returns a copy of the client using a different per call timeout
+func (c *ChainClient) WithTimeout(timeout time.Duration) *ChainClient {
+	cc := *c
+	cc.Timeout = timeout
+	return &cc
+}
+
+func (c *ChainClient) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.Timeout)
+}
+
 func (c *ChainClient) CallUint(to string, fn string, args ...interface{}) *BigInt {
 	return Bni(c.Call(to, fn, args...)[0])
 }
 
+func (c *ChainClient) CallUintErr(ctx context.Context, to string, fn string, args ...interface{}) (*BigInt, error) {
+	result, err := c.CallErr(ctx, to, fn, args...)
+	if err != nil {
+		return nil, err
+	}
+	return Bni(result[0]), nil
+}
+
 func (c *ChainClient) Call(to string, fn string, args ...interface{}) []interface{} {
 	return c.CallWithBlock(nil, to, fn, args...)
 }
 
+func (c *ChainClient) CallErr(ctx context.Context, to string, fn string, args ...interface{}) ([]interface{}, error) {
+	return c.CallWithBlockErr(ctx, nil, to, fn, args...)
+}
+
 func (c *ChainClient) CallWithBlock(block *big.Int, to string, fn string, args ...interface{}) []interface{} {
-	// parse fn string
-	var err error
+	result, err := c.CallWithBlockErr(context.Background(), block, to, fn, args...)
+	Check(err)
+	return result
+}
+
+// CallWithBlockErr calls `fn` (a "name-inputs-outputs" function string) on `to` at
+// the given block (nil for latest). Errors are returned as *ChainError.
+func (c *ChainClient) CallWithBlockErr(ctx context.Context, block *big.Int, to string, fn string, args ...interface{}) ([]interface{}, error) {
+	method, isWrite := parseFn(fn)
+	args = chainArgs(method.Inputs, args)
+
+	// build message
+	message := ethereum.CallMsg{}
+	bto := common.HexToAddress(to)
+	message.To = &bto
+	data, err := packFn(method, args)
+	if err != nil {
+		return nil, fmt.Errorf("chain: packing %s %s: %w", to, fn, err)
+	}
+	message.Data = data
+
+	if isWrite {
+		if c.Txs == nil {
+			return nil, fmt.Errorf("chain: %s %s: no TxManager for writes", to, fn)
+		}
+		tx, err := c.Txs.send(ctx, to, fn, data)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{tx.Hash}, nil
+	}
+
+	// call and unpack result
+	var bs []byte
+	err = c.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+		bs, err = client.CallContract(ctx, message, block)
+		return err
+	})
+	if err != nil {
+		return nil, newChainCallError(to, fn, err)
+	}
+	result, err := method.Outputs.Unpack(bs)
+	if err != nil {
+		return nil, newChainDecodeError(to, fn, err)
+	}
+	return result, nil
+}
+
+// parseFn parses a "name-inputs-outputs" function string (e.g.
+// "balanceOf-address-uint256") into an abi method. A leading "+" marks a write.
+func parseFn(fn string) (abi.Method, bool) {
 	parts := strings.Split(fn, "-")
 	name := parts[0]
 	isWrite := name[0] == '+'
@@ -186,31 +283,15 @@ func (c *ChainClient) CallWithBlock(block *big.Int, to string, fn string, args .
 	inputs := strings.Split(parts[1], ",")
 	outputs := strings.Split(parts[2], ",")
 
-	// build abi
 	mInputs := abi.Arguments{}
 	mOutputs := abi.Arguments{}
-	for j, i := range inputs {
+	for _, i := range inputs {
 		if i == "" {
 			continue
 		}
 		t, err := abi.NewType(i, i, nil)
 		Check(err)
 		mInputs = append(mInputs, abi.Argument{Type: t})
-		if i == "address" {
-			if a, ok := args[j].(string); ok {
-				args[j] = common.HexToAddress(a)
-			}
-		}
-		if i == "bytes" {
-			if b, ok := args[j].(string); ok {
-				args[j] = hexutil.MustDecode(b)
-			}
-		}
-		if strings.HasPrefix(i, "uint") || strings.HasPrefix(i, "int") {
-			if n, ok := args[j].(*BigInt); ok {
-				args[j] = n.Std()
-			}
-		}
 	}
 	for _, o := range outputs {
 		if o == "" {
@@ -220,79 +301,119 @@ func (c *ChainClient) CallWithBlock(block *big.Int, to string, fn string, args .
 		Check(err)
 		mOutputs = append(mOutputs, abi.Argument{Type: t})
 	}
-	method := abi.NewMethod(name, name, abi.Function, "view", false, false, mInputs, mOutputs)
-	fnabi := &abi.ABI{}
-	fnabi.Methods = map[string]abi.Method{name: method}
-
-	// build message
-	message := ethereum.CallMsg{}
-	bto := common.HexToAddress(to)
-	message.To = &bto
-	message.Data, err = fnabi.Pack(name, args...)
-	Check(err)
+	return abi.NewMethod(name, name, abi.Function, "view", false, false, mInputs, mOutputs), isWrite
+}
 
-	if !isWrite {
-		// call and unpack result
-		bs, err := c.Client.CallContract(context.Background(), message, block)
-		Check(err)
-		result, err := fnabi.Unpack(name, bs)
-		Check(err)
-		return result
-	} else {
-		message.From = c.WalletAddress
-		data := &types.DynamicFeeTx{}
-		data.Gas, err = c.Client.EstimateGas(context.Background(), message)
-		if err != nil {
-			var trace interface{}
-			c.Client.Client().Call(&trace, "debug_traceCall", J{
-				"from": c.WalletAddress.String(),
-				"to":   to,
-				"data": hexutil.Encode(message.Data),
-			}, "latest", J{"tracer": "callTracer"})
-			bs, _ := json.MarshalIndent(trace, "", "  ")
-			fmt.Println(string(bs))
-			panic(fmt.Errorf("error estimating gas: %w: %s %s %v", err, to, fn, args))
-		}
-		data.Nonce, err = c.Client.PendingNonceAt(context.Background(), message.From)
-		Check(err)
-		data.GasTipCap = Bn(1, 0).Std()
-		data.GasFeeCap = Bn(200000000, 0).Std()
-		data.ChainID = c.ChainID
-		data.To = message.To
-		data.Data = message.Data
-		tx := types.MustSignNewTx(c.WalletKey, types.LatestSignerForChainID(c.ChainID), data)
-		if IsProduction() {
-			Check(c.Client.SendTransaction(context.Background(), tx))
-		}
-		return []interface{}{tx.Hash().Hex()}
+func packFn(method abi.Method, args []interface{}) ([]byte, error) {
+	data, err := method.Inputs.Pack(args...)
+	if err != nil {
+		return nil, err
 	}
+	return append(append([]byte{}, method.ID...), data...), nil
 }
 
-func (c *ChainClient) FilterLogs(address string, topics []string) []types.Log {
-	etopics := [][]common.Hash{}
-	for _, t := range topics {
-		etopics = append(etopics, []common.Hash{common.HexToHash(t)})
+// CallMethod calls a registered contract method and decodes its outputs into result
+func (c *ChainClient) CallMethod(result interface{}, m *ContractMethod, to string, args ...interface{}) {
+	c.CallMethodWithBlock(nil, result, m, to, args...)
+}
+
+func (c *ChainClient) CallMethodErr(ctx context.Context, result interface{}, m *ContractMethod, to string, args ...interface{}) error {
+	return c.CallMethodWithBlockErr(ctx, nil, result, m, to, args...)
+}
+
+func (c *ChainClient) CallMethodWithBlock(block *big.Int, result interface{}, m *ContractMethod, to string, args ...interface{}) {
+	Check(c.CallMethodWithBlockErr(context.Background(), block, result, m, to, args...))
+}
+
+func (c *ChainClient) CallMethodWithBlockErr(ctx context.Context, block *big.Int, result interface{}, m *ContractMethod, to string, args ...interface{}) error {
+	data, err := m.Pack(args...)
+	if err != nil {
+		return err
 	}
-	logs, err := c.Client.FilterLogs(context.Background(), ethereum.FilterQuery{
-		FromBlock: big.NewInt(39117212),
-		Addresses: []common.Address{common.HexToAddress(address)},
-		Topics:    etopics,
+	bto := common.HexToAddress(to)
+	var bs []byte
+	err = c.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+		bs, err = client.CallContract(ctx, ethereum.CallMsg{To: &bto, Data: data}, block)
+		return err
 	})
+	if err != nil {
+		return newChainCallError(to, m.Contract+"."+m.Name, err)
+	}
+	return newChainDecodeError(to, m.Contract+"."+m.Name, m.Unpack(result, bs))
+}
+
+func (c *ChainClient) FilterLogs(address string, topics []string) []types.Log {
+	logs, err := c.FilterLogsErr(context.Background(), address, topics)
 	Check(err)
 	return logs
 }
 
+func (c *ChainClient) FilterLogsErr(ctx context.Context, address string, topics []string) ([]types.Log, error) {
+	return c.filterLogs(ctx, address, topics, nil)
+}
+
 func (c *ChainClient) FilterLogsBlock(address string, topics []string, toBlock int64) []types.Log {
+	logs, err := c.FilterLogsBlockErr(context.Background(), address, topics, toBlock)
+	Check(err)
+	return logs
+}
+
+func (c *ChainClient) FilterLogsBlockErr(ctx context.Context, address string, topics []string, toBlock int64) ([]types.Log, error) {
+	return c.filterLogs(ctx, address, topics, big.NewInt(toBlock))
+}
+
+func (c *ChainClient) filterLogs(ctx context.Context, address string, topics []string, toBlock *big.Int) ([]types.Log, error) {
 	etopics := [][]common.Hash{}
 	for _, t := range topics {
 		etopics = append(etopics, []common.Hash{common.HexToHash(t)})
 	}
-	logs, err := c.Client.FilterLogs(context.Background(), ethereum.FilterQuery{
-		FromBlock: big.NewInt(39117212),
-		ToBlock:   big.NewInt(toBlock),
+	if toBlock == nil {
+		head, err := c.BlockNumberErr(ctx)
+		if err != nil {
+			return nil, err
+		}
+		toBlock = new(big.Int).SetUint64(head)
+	}
+	return c.filterLogsRange(ctx, ethereum.FilterQuery{
 		Addresses: []common.Address{common.HexToAddress(address)},
 		Topics:    etopics,
+	}, 39117212, toBlock.Int64())
+}
+
+// FilterLogsQueryErr runs an arbitrary log query, for when a block range or
+// several addresses / topic alternatives are needed
+func (c *ChainClient) FilterLogsQueryErr(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	var logs []types.Log
+	err := c.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+		logs, err = client.FilterLogs(ctx, query)
+		return err
 	})
-	Check(err)
-	return logs
+	if err != nil {
+		addresses := []string{}
+		for _, a := range query.Addresses {
+			addresses = append(addresses, a.String())
+		}
+		return nil, newChainCallError(strings.Join(addresses, ","), "eth_getLogs", err)
+	}
+	return logs, nil
+}
+
+// BlockNumberErr returns the latest block number
+func (c *ChainClient) BlockNumberErr(ctx context.Context) (uint64, error) {
+	var number uint64
+	err := c.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+		number, err = client.BlockNumber(ctx)
+		return err
+	})
+	return number, newChainCallError("", "eth_blockNumber", err)
+}
+
+// HeaderErr returns the header of the given block (nil for latest)
+func (c *ChainClient) HeaderErr(ctx context.Context, number *big.Int) (*types.Header, error) {
+	var header *types.Header
+	err := c.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+		header, err = client.HeaderByNumber(ctx, number)
+		return err
+	})
+	return header, newChainCallError("", "eth_getBlockByNumber", err)
 }
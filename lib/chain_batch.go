@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// BatchSize is the maximum number of calls sent in a single Multicall3 aggregate
+var BatchSize = 150
+
+type multicallCall struct {
+	Target       common.Address
+	AllowFailure bool
+	CallData     []byte
+}
+
+type multicallResult struct {
+	Success    bool
+	ReturnData []byte
+}
+
+var multicallAggregate3 = RegisterContractMethod("IMulticall3", "aggregate3", []multicallResult{})
+
+// BatchCall is a single call queued in a Batch. Result and Err are set once the batch has ran.
+type BatchCall struct {
+	To     string
+	Fn     string
+	Result []interface{}
+	Err    error
+
+	method       abi.Method
+	contract     *ContractMethod
+	target       interface{}
+	data         []byte
+	allowFailure bool
+}
+
+// Uint returns the first result of the call as a BigInt (or ZERO if the call failed)
+func (bc *BatchCall) Uint() *BigInt {
+	if bc.Err != nil || len(bc.Result) == 0 {
+		return ZERO
+	}
+	return Bni(bc.Result[0])
+}
+
+// Batch collects read calls to run them through Multicall3 in as few round trips as possible
+type Batch struct {
+	client *ChainClient
+	block  *big.Int
+	calls  []*BatchCall
+}
+
+// Batch returns a new empty batch of read calls
+func (c *ChainClient) Batch() *Batch {
+	return &Batch{client: c}
+}
+
+// BatchWithBlock returns a new empty batch of read calls made against a past block
+func (c *ChainClient) BatchWithBlock(block *big.Int) *Batch {
+	return &Batch{client: c, block: block}
+}
+
+// Call queues a call using the same "name-inputs-outputs" function string as ChainClient.Call.
+// Run panics if this call fails.
+func (b *Batch) Call(to string, fn string, args ...interface{}) *BatchCall {
+	return b.add(to, fn, false, args)
+}
+
+// TryCall queues a call like Call but a failure is recorded on the call's Err instead of failing the batch
+func (b *Batch) TryCall(to string, fn string, args ...interface{}) *BatchCall {
+	return b.add(to, fn, true, args)
+}
+
+// CallMethod queues a call to a registered contract method, decoded into result once the batch ran
+func (b *Batch) CallMethod(result interface{}, m *ContractMethod, to string, args ...interface{}) *BatchCall {
+	return b.addMethod(result, m, to, false, args)
+}
+
+// TryCallMethod queues a call like CallMethod but a failure is recorded on the call's Err instead of failing the batch
+func (b *Batch) TryCallMethod(result interface{}, m *ContractMethod, to string, args ...interface{}) *BatchCall {
+	return b.addMethod(result, m, to, true, args)
+}
+
+func (b *Batch) add(to string, fn string, allowFailure bool, args []interface{}) *BatchCall {
+	method, isWrite := parseFn(fn)
+	if isWrite {
+		panic(fmt.Errorf("Batch: can't batch write call: %s", fn))
+	}
+	data, err := packFn(method, chainArgs(method.Inputs, args))
+	Check(err)
+	bc := &BatchCall{To: to, Fn: fn, method: method, data: data, allowFailure: allowFailure}
+	b.calls = append(b.calls, bc)
+	return bc
+}
+
+func (b *Batch) addMethod(result interface{}, m *ContractMethod, to string, allowFailure bool, args []interface{}) *BatchCall {
+	data, err := m.Pack(args...)
+	Check(err)
+	bc := &BatchCall{To: to, Fn: m.Contract + "." + m.Name, contract: m, target: result, data: data, allowFailure: allowFailure}
+	b.calls = append(b.calls, bc)
+	return bc
+}
+
+// Len returns the number of queued calls
+func (b *Batch) Len() int {
+	return len(b.calls)
+}
+
+// Run executes all queued calls. It panics if the multicall itself fails or if
+// a call not queued with TryCall/TryCallMethod reverts or can't be decoded.
+func (b *Batch) Run() {
+	Check(b.RunErr(context.Background()))
+}
+
+// RunErr executes all queued calls, returning a *ChainError instead of panicking.
+// The queue is emptied either way, a batch that failed doesn't resend its calls
+// when reused.
+func (b *Batch) RunErr(ctx context.Context) error {
+	defer func() { b.calls = nil }()
+	for start := 0; start < len(b.calls); start += BatchSize {
+		end := Min(start+BatchSize, len(b.calls))
+		if err := b.runChunk(ctx, b.calls[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Batch) runChunk(ctx context.Context, calls []*BatchCall) error {
+	requests := []multicallCall{}
+	for _, bc := range calls {
+		requests = append(requests, multicallCall{
+			Target:       common.HexToAddress(bc.To),
+			AllowFailure: bc.allowFailure,
+			CallData:     bc.data,
+		})
+	}
+	data, err := multicallAggregate3.Pack(requests)
+	if err != nil {
+		return err
+	}
+	to := common.HexToAddress(Env("MULTICALL_ADDRESS", "0xcA11bde05977b3631167028862bE2a173976CA11"))
+	var bs []byte
+	err = b.client.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+		bs, err = client.CallContract(ctx, ethereum.CallMsg{To: &to, Data: data}, b.block)
+		return err
+	})
+	if err != nil {
+		return newChainCallError(to.String(), fmt.Sprintf("aggregate3(%d calls)", len(calls)), err)
+	}
+	results := []multicallResult{}
+	if err := multicallAggregate3.Unpack(&results, bs); err != nil {
+		return newChainDecodeError(to.String(), "aggregate3", err)
+	}
+	if len(results) != len(calls) {
+		return fmt.Errorf("Batch: expected %d results got %d", len(calls), len(results))
+	}
+	for i, bc := range calls {
+		bc.Err = bc.decode(results[i])
+		if bc.Err != nil && !bc.allowFailure {
+			return bc.Err
+		}
+	}
+	return nil
+}
+
+func (bc *BatchCall) decode(r multicallResult) error {
+	if !r.Success {
+		return &ChainError{Kind: ChainErrorRevert, To: bc.To, Fn: bc.Fn, Reason: decodeRevert(r.ReturnData), Err: errors.New("call reverted")}
+	}
+	if bc.contract != nil {
+		return newChainDecodeError(bc.To, bc.Fn, bc.contract.Unpack(bc.target, r.ReturnData))
+	}
+	result, err := bc.method.Outputs.Unpack(r.ReturnData)
+	if err != nil {
+		return newChainDecodeError(bc.To, bc.Fn, err)
+	}
+	bc.Result = result
+	return nil
+}
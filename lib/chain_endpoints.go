@@ -0,0 +1,295 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	// ChainEndpointMaxErrors is the number of consecutive failures after which an endpoint is ejected
+	ChainEndpointMaxErrors = 3
+	// ChainEndpointEjectFor is how long an ejected endpoint is avoided for
+	ChainEndpointEjectFor = time.Minute
+	// ChainEndpointMaxLag is how many blocks an endpoint can be behind the highest one seen before being ejected
+	ChainEndpointMaxLag uint64 = 50
+	// ChainEndpointCheckEvery is the interval at which block heights are polled for lag detection
+	ChainEndpointCheckEvery = 15 * time.Second
+)
+
+// ChainEndpoint is one RPC provider for a chain along with its health stats
+type ChainEndpoint struct {
+	URL    string
+	client *ethclient.Client
+
+	mu           sync.Mutex
+	latency      time.Duration
+	requests     int64
+	errors       int64
+	failures     int
+	blockNumber  uint64
+	ejectedUntil time.Time
+	lastError    string
+}
+
+// ChainEndpointHealth is a snapshot of an endpoint's health, safe to expose to ops
+type ChainEndpointHealth struct {
+	URL          string    `json:"url"`
+	Healthy      bool      `json:"healthy"`
+	EjectedUntil time.Time `json:"ejectedUntil"`
+	LatencyMs    int64     `json:"latencyMs"`
+	Requests     int64     `json:"requests"`
+	Errors       int64     `json:"errors"`
+	BlockNumber  uint64    `json:"blockNumber"`
+	Lag          uint64    `json:"lag"`
+	LastError    string    `json:"lastError"`
+}
+
+func newChainEndpoint(rawURL string) *ChainEndpoint {
+	client, err := ethclient.Dial(rawURL)
+	Check(err)
+	return &ChainEndpoint{URL: rawURL, client: client}
+}
+
+func (e *ChainEndpoint) healthy(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return now.After(e.ejectedUntil)
+}
+
+func (e *ChainEndpoint) record(took time.Duration, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests++
+	if err != nil {
+		e.errors++
+		e.failures++
+		e.lastError = err.Error()
+		if e.failures >= ChainEndpointMaxErrors {
+			e.eject("errors")
+		}
+		return
+	}
+	e.failures = 0
+	// Exponentially weighted so a slow patch shows up quickly but one slow call doesn't dominate
+	if e.latency == 0 {
+		e.latency = took
+	} else {
+		e.latency = (e.latency*4 + took) / 5
+	}
+}
+
+// eject must be called with the lock held
+func (e *ChainEndpoint) eject(reason string) {
+	until := time.Now().Add(ChainEndpointEjectFor)
+	if until.After(e.ejectedUntil) {
+		Log("warning", "chain endpoint ejected", J{"url": redactURL(e.URL), "reason": reason, "error": e.lastError})
+		e.ejectedUntil = until
+	}
+	e.failures = 0
+}
+
+func (e *ChainEndpoint) health(maxBlock uint64, now time.Time) ChainEndpointHealth {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	h := ChainEndpointHealth{
+		URL:          redactURL(e.URL),
+		Healthy:      now.After(e.ejectedUntil),
+		EjectedUntil: e.ejectedUntil,
+		LatencyMs:    e.latency.Milliseconds(),
+		Requests:     e.requests,
+		Errors:       e.errors,
+		BlockNumber:  e.blockNumber,
+		LastError:    e.lastError,
+	}
+	if maxBlock > e.blockNumber {
+		h.Lag = maxBlock - e.blockNumber
+	}
+	return h
+}
+
+// parseChainEndpoints splits a comma separated list of RPC urls
+func parseChainEndpoints(urls string) []*ChainEndpoint {
+	endpoints := []*ChainEndpoint{}
+	for _, u := range strings.Split(urls, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			endpoints = append(endpoints, newChainEndpoint(u))
+		}
+	}
+	return endpoints
+}
+
+// ordered returns endpoints in the order they should be tried: healthy ones first
+// (by latency or round robin depending on RPC_STRATEGY), then ejected ones as a last resort
+func (c *ChainClient) ordered() []*ChainEndpoint {
+	now := time.Now()
+	healthy := []*ChainEndpoint{}
+	ejected := []*ChainEndpoint{}
+	for _, e := range c.endpoints {
+		if e.healthy(now) {
+			healthy = append(healthy, e)
+		} else {
+			ejected = append(ejected, e)
+		}
+	}
+	if c.strategy == "round-robin" {
+		if len(healthy) > 1 {
+			offset := int(atomic.AddUint64(&c.next, 1) % uint64(len(healthy)))
+			healthy = append(healthy[offset:], healthy[:offset]...)
+		}
+	} else {
+		sort.SliceStable(healthy, func(i, j int) bool {
+			healthy[i].mu.Lock()
+			a := healthy[i].latency
+			healthy[i].mu.Unlock()
+			healthy[j].mu.Lock()
+			b := healthy[j].latency
+			healthy[j].mu.Unlock()
+			return a < b
+		})
+	}
+	return append(healthy, ejected...)
+}
+
+// Do runs fn against the best available endpoint, failing over to the next one
+// when fn fails for reasons that are the endpoint's rather than the call's. Each
+// attempt gets its own Timeout so a slow endpoint doesn't leave none for the next one.
+func (c *ChainClient) Do(ctx context.Context, fn func(ctx context.Context, client *ethclient.Client) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var err error
+	for _, e := range c.ordered() {
+		start := time.Now()
+		attemptCtx, cancel := c.context(ctx)
+		err = fn(attemptCtx, e.client)
+		cancel()
+		if ctx.Err() != nil {
+			// The caller gave up or ran out of time, not the endpoint's fault
+			return err
+		}
+		if !isEndpointError(ctx, err) {
+			e.record(time.Since(start), nil)
+			return err
+		}
+		e.record(time.Since(start), err)
+	}
+	return err
+}
+
+// chainCallerErrors are messages of RPC errors caused by what was asked (a log
+// range the provider won't serve, a method it doesn't have) rather than the
+// endpoint failing. Some providers send them with rate limit codes.
+var chainCallerErrors = []string{
+	"range too large", "block range", "range is too large", "too many results",
+	"more than 10000 results", "response size exceeded", "method not found",
+	"does not exist/is not available", "not supported",
+}
+
+// chainRateLimitCodes are the JSON-RPC error codes providers use for rate limits
+var chainRateLimitCodes = map[int]bool{-32005: true, -32029: true, -32090: true, 429: true}
+
+// isEndpointError tells if an error is the endpoint's fault (transport errors,
+// timeouts, HTTP 429 and 5xx, rate limits) rather than a result of the call
+// (reverts, rejected txs, unservable queries) which would fail on any endpoint
+func isEndpointError(ctx context.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	if ctx.Err() != nil {
+		// The caller went away or its deadline passed, not the endpoint's fault
+		return false
+	}
+	if reverted, _ := chainRevert(err); reverted {
+		return false
+	}
+	message := strings.ToLower(err.Error())
+	for _, m := range chainCallerErrors {
+		if strings.Contains(message, m) {
+			return false
+		}
+	}
+	var he rpc.HTTPError
+	if errors.As(err, &he) {
+		return he.StatusCode == 429 || he.StatusCode >= 500
+	}
+	var re rpc.Error
+	if errors.As(err, &re) {
+		return chainRateLimitCodes[re.ErrorCode()] ||
+			strings.Contains(message, "rate limit") || strings.Contains(message, "too many requests")
+	}
+	// Anything else never got a JSON-RPC answer: connection failures, timeouts,
+	// bad responses
+	return true
+}
+
+// Health returns a snapshot of every endpoint's health
+func (c *ChainClient) Health() []ChainEndpointHealth {
+	var maxBlock uint64
+	for _, e := range c.endpoints {
+		e.mu.Lock()
+		if e.blockNumber > maxBlock {
+			maxBlock = e.blockNumber
+		}
+		e.mu.Unlock()
+	}
+	health := []ChainEndpointHealth{}
+	now := time.Now()
+	for _, e := range c.endpoints {
+		health = append(health, e.health(maxBlock, now))
+	}
+	return health
+}
+
+// monitor polls every endpoint's block height to eject the ones lagging behind
+func (c *ChainClient) monitor() {
+	for {
+		c.checkEndpoints()
+		time.Sleep(ChainEndpointCheckEvery)
+	}
+}
+
+func (c *ChainClient) checkEndpoints() {
+	var maxBlock uint64
+	for _, e := range c.endpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		start := time.Now()
+		block, err := e.client.BlockNumber(ctx)
+		cancel()
+		e.record(time.Since(start), err)
+		if err != nil {
+			continue
+		}
+		e.mu.Lock()
+		e.blockNumber = block
+		e.mu.Unlock()
+		if block > maxBlock {
+			maxBlock = block
+		}
+	}
+	for _, e := range c.endpoints {
+		e.mu.Lock()
+		if e.blockNumber > 0 && e.blockNumber+ChainEndpointMaxLag < maxBlock {
+			e.lastError = "lagging behind by " + IntToString(int64(maxBlock-e.blockNumber)) + " blocks"
+			e.eject("lag")
+		}
+		e.mu.Unlock()
+	}
+}
+
+// redactURL strips paths and query strings from RPC urls as they often contain API keys
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid"
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	ChainErrorRevert = "revert"
+	ChainErrorRPC    = "rpc"
+	ChainErrorDecode = "decode"
+	// ChainErrorDropped is a sent transaction that was never mined, replaced by
+	// another one with its nonce
+	ChainErrorDropped = "dropped"
+)
+
+// ChainError is returned by the ChainClient `...Err` methods. Kind tells apart a
+// reverted call (with the decoded revert Reason when possible), a failure talking
+// to the RPC endpoint (including timeouts), return data we couldn't decode, and a
+// sent transaction that was dropped.
+type ChainError struct {
+	Kind   string
+	To     string
+	Fn     string
+	Reason string
+	Err    error
+}
+
+func (e *ChainError) Error() string {
+	if e.Kind == ChainErrorRevert && e.Reason != "" {
+		return fmt.Sprintf("chain: %s %s: reverted: %s", e.To, e.Fn, e.Reason)
+	}
+	return fmt.Sprintf("chain: %s %s: %s: %v", e.To, e.Fn, e.Kind, e.Err)
+}
+
+func (e *ChainError) Unwrap() error {
+	return e.Err
+}
+
+// IsChainError reports whether err is a ChainError of the given kind
+func IsChainError(err error, kind string) bool {
+	var ce *ChainError
+	return errors.As(err, &ce) && ce.Kind == kind
+}
+
+// contractErrors maps custom error selectors from loaded ABIs so reverts can be named
+var contractErrors = map[[4]byte]abi.Error{}
+
+// chainRevert tells if an RPC error is the call reverting (code 3, an
+// "execution reverted" message or revert data) rather than the endpoint
+// failing, along with the revert data when there's some
+func chainRevert(err error) (bool, []byte) {
+	if err == nil {
+		return false, nil
+	}
+	var data []byte
+	var de rpc.DataError
+	if errors.As(err, &de) {
+		if s, ok := de.ErrorData().(string); ok {
+			data, _ = hexutil.Decode(s)
+		}
+	}
+	var re rpc.Error
+	if len(data) > 0 || (errors.As(err, &re) && re.ErrorCode() == 3) || strings.Contains(err.Error(), "execution reverted") {
+		return true, data
+	}
+	return false, nil
+}
+
+func newChainCallError(to, fn string, err error) error {
+	if err == nil {
+		return nil
+	}
+	ce := &ChainError{Kind: ChainErrorRPC, To: to, Fn: fn, Err: err}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return ce
+	}
+	if reverted, data := chainRevert(err); reverted {
+		ce.Kind = ChainErrorRevert
+		ce.Reason = decodeRevert(data)
+	}
+	return ce
+}
+
+func newChainDecodeError(to, fn string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ChainError{Kind: ChainErrorDecode, To: to, Fn: fn, Err: err}
+}
+
+// decodeRevert turns revert data into a readable reason: Error(string),
+// Panic(uint256) or a custom error known from the loaded contract ABIs
+func decodeRevert(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	if reason, err := abi.UnpackRevert(data); err == nil {
+		return reason
+	}
+	if len(data) >= 4 {
+		var id [4]byte
+		copy(id[:], data[:4])
+		if e, ok := contractErrors[id]; ok {
+			if values, err := e.Inputs.Unpack(data[4:]); err == nil && len(values) > 0 {
+				return fmt.Sprintf("%s%v", e.Name, values)
+			}
+			return e.Name
+		}
+	}
+	return hexutil.Encode(data)
+}
@@ -0,0 +1,274 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	// LogRangeDefault is the number of blocks asked for in a single eth_getLogs to begin with
+	LogRangeDefault int64 = 5000
+	// LogRangeMax caps how large the range grows to after successful queries
+	LogRangeMax int64 = 100000
+)
+
+// LogCursor is the persisted progress of a LogScanner
+type LogCursor struct {
+	ID      string
+	Block   int64
+	Hash    string
+	Size    int64
+	Updated time.Time
+}
+
+// LogScanner follows the logs of a subscription (addresses and topics) from a
+// start block, handing them over page by page and remembering where it got to.
+// Pages go up to the head. The hashes of recent blocks are kept so that when a
+// reorg replaces blocks already handed over (up to Confirmations deep) the
+// scanner rolls back to the fork and hands the new logs over again.
+// Handlers should be idempotent, a page can be handed over again after a crash.
+type LogScanner struct {
+	ID            string
+	Query         ethereum.FilterQuery
+	Start         int64
+	Confirmations int64
+	// MaxPages caps the pages handled per Scan call, 0 for until the head
+	MaxPages int
+
+	client *ChainClient
+	db     *Database
+}
+
+// NewLogScanner creates a scanner for logs emitted by addresses with the given topics (per
+// position, each allowing alternatives, like FilterQuery). Its ID, used to persist
+// its cursor, is derived from the subscription unless set afterwards.
+func NewLogScanner(db *Database, client *ChainClient, start int64, addresses []string, topics ...[]string) *LogScanner {
+	s := &LogScanner{Start: start, Confirmations: 64, client: client, db: db}
+	id := client.ChainID.String()
+	for _, a := range addresses {
+		s.Query.Addresses = append(s.Query.Addresses, common.HexToAddress(a))
+		id += ":" + strings.ToLower(a)
+	}
+	for _, alternatives := range topics {
+		hashes := []common.Hash{}
+		for _, t := range alternatives {
+			hashes = append(hashes, common.HexToHash(t))
+			id += ":" + t
+		}
+		s.Query.Topics = append(s.Query.Topics, hashes)
+	}
+	s.ID = crypto.Keccak256Hash([]byte(id)).Hex()[2:18]
+	return s
+}
+
+// Cursor returns the scanner's persisted progress (Block is Start-1 before the first scan)
+func (s *LogScanner) Cursor() (*LogCursor, error) {
+	cursor := &LogCursor{}
+	err := s.db.FirstErr(cursor, `select * from app_log_cursors where id = $1`, s.ID)
+	if err == ErrDatabaseNotFound {
+		return &LogCursor{ID: s.ID, Block: s.Start - 1, Size: LogRangeDefault}, nil
+	}
+	return cursor, err
+}
+
+// Scan hands over new logs to handle one page at a time, in block order. When a
+// reorg replaced blocks already handed over, rollback is called first with the
+// first block whose logs must be undone.
+func (s *LogScanner) Scan(ctx context.Context, handle func(logs []types.Log, from, to int64) error, rollback func(from int64) error) error {
+	cursor, err := s.Cursor()
+	if err != nil {
+		return err
+	}
+	if err := s.checkReorg(ctx, cursor, rollback); err != nil {
+		return err
+	}
+	head, err := s.client.BlockNumberErr(ctx)
+	if err != nil {
+		return err
+	}
+	for pages := 0; cursor.Block < int64(head) && (s.MaxPages == 0 || pages < s.MaxPages); pages++ {
+		from := cursor.Block + 1
+		logs, to, err := s.client.filterLogsPage(ctx, s.Query, from, int64(head), &cursor.Size)
+		if err != nil {
+			return err
+		}
+		header, err := s.client.HeaderErr(ctx, big.NewInt(to))
+		if err != nil {
+			return err
+		}
+		if err := s.checkLogs(ctx, logs, header, int64(head)); err != nil {
+			return err
+		}
+		if err := handle(logs, from, to); err != nil {
+			return err
+		}
+		cursor.Block = to
+		cursor.Hash = header.Hash().Hex()
+		if err := s.save(cursor, int64(head), logs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrLogsReorged is returned by Scan when a reorg happened while reading a page,
+// it's handed over on the next one
+var ErrLogsReorged = errors.New("log scanner: blocks changed while reading logs")
+
+// checkLogs makes sure the logs of recent blocks (which can still be reorged)
+// are from the chain header is on, so we don't hand over logs of a fork and
+// then save the hash of the other as where we got to
+func (s *LogScanner) checkLogs(ctx context.Context, logs []types.Log, header *types.Header, head int64) error {
+	hashes := map[uint64]common.Hash{header.Number.Uint64(): header.Hash()}
+	for _, l := range logs {
+		if l.Removed {
+			return ErrLogsReorged
+		}
+		if int64(l.BlockNumber) <= head-s.Confirmations {
+			continue
+		}
+		hash, ok := hashes[l.BlockNumber]
+		if !ok {
+			h, err := s.client.HeaderErr(ctx, new(big.Int).SetUint64(l.BlockNumber))
+			if err != nil {
+				return err
+			}
+			hash = h.Hash()
+			hashes[l.BlockNumber] = hash
+		}
+		if l.BlockHash != hash {
+			return ErrLogsReorged
+		}
+	}
+	return nil
+}
+
+func (s *LogScanner) save(cursor *LogCursor, head int64, logs []types.Log) error {
+	cursor.Updated = time.Now()
+	err := s.db.ExecuteErr(`insert into app_log_cursors (id, block, hash, size, updated) values ($1, $2, $3, $4, $5)
+on conflict (id) do update set block = $2, hash = $3, size = $4, updated = $5`,
+		cursor.ID, cursor.Block, cursor.Hash, cursor.Size, cursor.Updated)
+	if err != nil {
+		return err
+	}
+	// Remember recent block hashes to find where a fork started
+	recent := head - s.Confirmations
+	hashes := map[int64]string{cursor.Block: cursor.Hash}
+	for _, l := range logs {
+		if int64(l.BlockNumber) > recent {
+			hashes[int64(l.BlockNumber)] = l.BlockHash.Hex()
+		}
+	}
+	for block, hash := range hashes {
+		err := s.db.ExecuteErr(`insert into app_log_blocks (cursor_id, block, hash) values ($1, $2, $3)
+on conflict (cursor_id, block) do update set hash = $3`, cursor.ID, block, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return s.db.ExecuteErr(`delete from app_log_blocks where cursor_id = $1 and block < $2 and block <> $3`, cursor.ID, recent, cursor.Block)
+}
+
+// checkReorg compares the hashes we saw against the chain's, newest first, to
+// find the last block we handed over that's still canonical
+func (s *LogScanner) checkReorg(ctx context.Context, cursor *LogCursor, rollback func(from int64) error) error {
+	if cursor.Hash == "" {
+		return nil
+	}
+	blocks := []struct {
+		Block int64
+		Hash  string
+	}{}
+	if err := s.db.AllErr(&blocks, `select block, hash from app_log_blocks where cursor_id = $1 order by block desc`, cursor.ID); err != nil {
+		return err
+	}
+	ancestor := int64(-1)
+	for i, b := range blocks {
+		header, err := s.client.HeaderErr(ctx, big.NewInt(b.Block))
+		if err != nil {
+			return err
+		}
+		if header.Hash().Hex() == b.Hash {
+			if i == 0 {
+				return nil
+			}
+			ancestor = b.Block
+			break
+		}
+	}
+	if ancestor < 0 {
+		// Deeper than we keep hashes for, go back as far as we promise to handle
+		ancestor = cursor.Block - s.Confirmations
+		if len(blocks) > 0 && blocks[len(blocks)-1].Block-1 < ancestor {
+			ancestor = blocks[len(blocks)-1].Block - 1
+		}
+	}
+	if ancestor < s.Start-1 {
+		ancestor = s.Start - 1
+	}
+	Log("warning", "log scanner: reorg detected", J{"id": s.ID, "block": cursor.Block, "rollback": ancestor + 1})
+	if err := rollback(ancestor + 1); err != nil {
+		return err
+	}
+	if err := s.db.ExecuteErr(`delete from app_log_blocks where cursor_id = $1 and block > $2`, cursor.ID, ancestor); err != nil {
+		return err
+	}
+	cursor.Block = ancestor
+	cursor.Hash = ""
+	if header, err := s.client.HeaderErr(ctx, big.NewInt(ancestor)); err == nil && ancestor >= 0 {
+		cursor.Hash = header.Hash().Hex()
+	}
+	return s.db.ExecuteErr(`update app_log_cursors set block = $2, hash = $3, updated = $4 where id = $1`, cursor.ID, cursor.Block, cursor.Hash, time.Now())
+}
+
+// filterLogsPage gets the logs for as many blocks from `from` as the provider
+// lets us, up to `to`. The range is halved when a query is rejected (too many
+// results, too many blocks, timeouts) and grown back after successful ones.
+func (c *ChainClient) filterLogsPage(ctx context.Context, query ethereum.FilterQuery, from, to int64, size *int64) ([]types.Log, int64, error) {
+	if *size <= 0 {
+		*size = LogRangeDefault
+	}
+	for {
+		end := from + *size - 1
+		if end > to {
+			end = to
+		}
+		query.FromBlock = big.NewInt(from)
+		query.ToBlock = big.NewInt(end)
+		logs, err := c.FilterLogsQueryErr(ctx, query)
+		if err == nil {
+			if end-from+1 == *size && *size*2 <= LogRangeMax {
+				*size *= 2
+			}
+			return logs, end, nil
+		}
+		if ctx.Err() != nil || errors.Is(err, context.Canceled) || *size == 1 {
+			return nil, 0, err
+		}
+		*size /= 2
+		Log("debug", "log range rejected, shrinking", J{"from": from, "range": *size, "error": err.Error()})
+	}
+}
+
+// filterLogsRange gets all the logs between two blocks, paging through them
+func (c *ChainClient) filterLogsRange(ctx context.Context, query ethereum.FilterQuery, from, to int64) ([]types.Log, error) {
+	all := []types.Log{}
+	size := LogRangeDefault
+	for from <= to {
+		logs, end, err := c.filterLogsPage(ctx, query, from, to, &size)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, logs...)
+		from = end + 1
+	}
+	return all, nil
+}
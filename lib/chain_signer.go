@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ErrNoSigner is returned when sending transactions from a ChainClient without a signer
+var ErrNoSigner = errors.New("chain: no signer configured")
+
+// Signer signs transactions for a ChainClient's wallet
+type Signer interface {
+	Address() common.Address
+	SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+}
+
+// NewSignerFromEnv picks a signer based on SIGNER: "key" (PRIVATE_KEY), "keystore"
+// (SIGNER_KEYSTORE file unlocked with SIGNER_KEYSTORE_PASSWORD), "remote"
+// (SIGNER_URL signing for SIGNER_ADDRESS) or "none". When SIGNER isn't set a
+// PRIVATE_KEY is used if present, so processes that never sign can just omit it.
+func NewSignerFromEnv() Signer {
+	kind := Env("SIGNER", "")
+	if kind == "" {
+		kind = "none"
+		if Env("PRIVATE_KEY", "") != "" {
+			kind = "key"
+		}
+	}
+	switch kind {
+	case "none":
+		return nil
+	case "key":
+		return NewKeySigner(Env("PRIVATE_KEY", ""))
+	case "keystore":
+		return NewKeystoreSigner(Env("SIGNER_KEYSTORE", ""), Env("SIGNER_KEYSTORE_PASSWORD", ""))
+	case "remote":
+		return NewRemoteSigner(Env("SIGNER_URL", ""), Env("SIGNER_ADDRESS", ""))
+	}
+	panic(fmt.Errorf("NewSignerFromEnv: unknown signer: %s", kind))
+}
+
+// KeySigner signs with a private key held in memory
+type KeySigner struct {
+	key *ecdsa.PrivateKey
+}
+
+// NewKeySigner creates a signer from a hex encoded private key
+func NewKeySigner(hexKey string) *KeySigner {
+	key, err := crypto.ToECDSA(common.FromHex(hexKey))
+	if err != nil {
+		panic(fmt.Errorf("NewKeySigner: invalid private key: %w", err))
+	}
+	return &KeySigner{key: key}
+}
+
+func (s *KeySigner) Address() common.Address {
+	return crypto.PubkeyToAddress(s.key.PublicKey)
+}
+
+func (s *KeySigner) SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.LatestSignerForChainID(chainID), s.key)
+}
+
+// NewKeystoreSigner decrypts a geth keystore (V3) file. The key is only held
+// decrypted by the process, it's encrypted at rest and out of the environment.
+func NewKeystoreSigner(path, password string) *KeySigner {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		panic(fmt.Errorf("NewKeystoreSigner: reading keystore: %w", err))
+	}
+	key, err := keystore.DecryptKey(bs, password)
+	if err != nil {
+		panic(fmt.Errorf("NewKeystoreSigner: decrypting keystore: %w", err))
+	}
+	return &KeySigner{key: key.PrivateKey}
+}
+
+// RemoteSigner asks an external signer over JSON-RPC to sign transactions,
+// either Clef's account_signTransaction or web3signer's eth_signTransaction
+// (set with SIGNER_METHOD). The key never enters this process.
+type RemoteSigner struct {
+	URL     string
+	Method  string
+	address common.Address
+}
+
+// NewRemoteSigner creates a signer for address backed by the signer at url
+func NewRemoteSigner(url, address string) *RemoteSigner {
+	if url == "" || !common.IsHexAddress(address) {
+		panic(errors.New("NewRemoteSigner: a url and address are required"))
+	}
+	return &RemoteSigner{URL: url, Method: Env("SIGNER_METHOD", "account_signTransaction"), address: common.HexToAddress(address)}
+}
+
+func (s *RemoteSigner) Address() common.Address {
+	return s.address
+}
+
+func (s *RemoteSigner) SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	client, err := rpc.DialContext(ctx, s.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	args := J{
+		"from":                 s.address,
+		"to":                   tx.To(),
+		"gas":                  hexutil.Uint64(tx.Gas()),
+		"maxFeePerGas":         (*hexutil.Big)(tx.GasFeeCap()),
+		"maxPriorityFeePerGas": (*hexutil.Big)(tx.GasTipCap()),
+		"value":                (*hexutil.Big)(tx.Value()),
+		"nonce":                hexutil.Uint64(tx.Nonce()),
+		"data":                 hexutil.Bytes(tx.Data()),
+		"input":                hexutil.Bytes(tx.Data()),
+		"chainId":              (*hexutil.Big)(chainID),
+	}
+	var result json.RawMessage
+	if err := client.CallContext(ctx, &result, s.Method, args); err != nil {
+		return nil, fmt.Errorf("RemoteSigner: %w", err)
+	}
+	// Clef returns {raw, tx}, web3signer returns the raw tx hex
+	var raw hexutil.Bytes
+	if err := json.Unmarshal(result, &raw); err != nil {
+		var clef struct{ Raw hexutil.Bytes }
+		if err := json.Unmarshal(result, &clef); err != nil {
+			return nil, fmt.Errorf("RemoteSigner: unexpected response: %s", result)
+		}
+		raw = clef.Raw
+	}
+	signed := &types.Transaction{}
+	if err := signed.UnmarshalBinary(raw); err != nil {
+		return nil, fmt.Errorf("RemoteSigner: decoding signed tx: %w", err)
+	}
+	// Don't trust the signer to have signed what we asked for
+	from, err := types.Sender(types.LatestSignerForChainID(chainID), signed)
+	if err != nil {
+		return nil, fmt.Errorf("RemoteSigner: recovering sender: %w", err)
+	}
+	if from != s.address || signed.Type() != tx.Type() || signed.ChainId().Cmp(chainID) != 0 || signed.Nonce() != tx.Nonce() ||
+		signed.To() == nil || tx.To() == nil || *signed.To() != *tx.To() || !bytes.Equal(signed.Data(), tx.Data()) ||
+		signed.Value().Cmp(tx.Value()) != 0 || signed.Gas() != tx.Gas() ||
+		signed.GasFeeCap().Cmp(tx.GasFeeCap()) != 0 || signed.GasTipCap().Cmp(tx.GasTipCap()) != 0 {
+		return nil, errors.New("RemoteSigner: signed tx doesn't match the request")
+	}
+	return signed, nil
+}
@@ -0,0 +1,218 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/lib/pq"
+)
+
+// ChainSimulation is the outcome of running a write call against pending state
+// without sending it, kept in app_simulations for review by SaveSimulation
+type ChainSimulation struct {
+	ID          string
+	ChainID     int64
+	Job         string
+	Label       string
+	FromAddress string
+	ToAddress   string
+	Method      string
+	Args        pq.StringArray
+	Data        string
+	Gas         int64
+	Success     bool
+	Revert      string
+	Calls       pq.StringArray
+	Created     time.Time
+}
+
+// Summary formats the simulation for humans reading job output
+func (s *ChainSimulation) Summary() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s %s.%s\n", s.Job, s.ToAddress, s.Method)
+	for _, a := range s.Args {
+		fmt.Fprintf(b, "  arg  %s\n", a)
+	}
+	if s.Success {
+		fmt.Fprintf(b, "  ok   gas %d\n", s.Gas)
+	} else {
+		fmt.Fprintf(b, "  FAIL %s\n", s.Revert)
+	}
+	for _, c := range s.Calls {
+		fmt.Fprintf(b, "  %s\n", c)
+	}
+	return b.String()
+}
+
+// Simulate runs a write call given as a "name-inputs-outputs" function string
+// against pending state. It's not traced nor kept unless passed to SaveSimulation.
+func (m *TxManager) Simulate(ctx context.Context, job string, to string, fn string, args ...interface{}) (*ChainSimulation, error) {
+	method, _ := parseFn(strings.TrimPrefix(fn, "+"))
+	args = chainArgs(method.Inputs, args)
+	data, err := packFn(method, args)
+	if err != nil {
+		return nil, fmt.Errorf("chain: packing %s %s: %w", to, fn, err)
+	}
+	return m.simulate(ctx, job, to, fn, method, args, data)
+}
+
+// SimulateMethod runs a write call to a registered contract method against pending state
+func (m *TxManager) SimulateMethod(ctx context.Context, job string, cm *ContractMethod, to string, args ...interface{}) (*ChainSimulation, error) {
+	data, err := cm.Pack(args...)
+	if err != nil {
+		return nil, err
+	}
+	return m.simulate(ctx, job, to, cm.Contract+"."+cm.Name, cm.Method, chainArgs(cm.Method.Inputs, args), data)
+}
+
+func (m *TxManager) simulate(ctx context.Context, job string, to string, label string, method abi.Method, args []interface{}, data []byte) (*ChainSimulation, error) {
+	c := m.client
+	bto := common.HexToAddress(to)
+	message := ethereum.CallMsg{From: c.WalletAddress, To: &bto, Data: data}
+	s := &ChainSimulation{
+		ID:          NewID(),
+		ChainID:     c.ChainID.Int64(),
+		Job:         job,
+		Label:       label,
+		FromAddress: c.WalletAddress.String(),
+		ToAddress:   bto.String(),
+		Method:      method.RawName,
+		Args:        formatChainArgs(method.Inputs, args),
+		Data:        hexutil.Encode(data),
+		Calls:       pq.StringArray{},
+		Created:     time.Now(),
+	}
+
+	err := c.Do(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		_, err := client.PendingCallContract(ctx, message)
+		return err
+	})
+	if err == nil {
+		var gas uint64
+		err = c.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+			gas, err = client.EstimateGas(ctx, message)
+			return err
+		})
+		s.Gas = int64(gas)
+	}
+	if err != nil {
+		ce := newChainCallError(to, label, err).(*ChainError)
+		if ce.Kind != ChainErrorRevert {
+			return nil, ce
+		}
+		s.Revert = ce.Reason
+		if s.Revert == "" {
+			s.Revert = err.Error()
+		}
+	}
+	s.Success = err == nil
+	return s, nil
+}
+
+// SaveSimulation traces a simulation's calls and keeps it in app_simulations,
+// for the ones worth reviewing (what's sent or dry runs) rather than all of them
+func (m *TxManager) SaveSimulation(ctx context.Context, s *ChainSimulation) error {
+	to := common.HexToAddress(s.ToAddress)
+	s.Calls = m.trace(ctx, ethereum.CallMsg{From: common.HexToAddress(s.FromAddress), To: &to, Data: hexutil.MustDecode(s.Data)}, "pending")
+	return m.db.ExecuteErr(`insert into app_simulations (id, chain_id, job, label, from_address, to_address, method, args, data, gas, success, revert, calls, created)
+values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		s.ID, s.ChainID, s.Job, s.Label, s.FromAddress, s.ToAddress, s.Method, s.Args, s.Data, s.Gas, s.Success, s.Revert, s.Calls, s.Created)
+}
+
+type chainTraceFrame struct {
+	Type         string
+	To           string
+	Input        string
+	GasUsed      hexutil.Uint64
+	Error        string
+	RevertReason string
+	Calls        []chainTraceFrame
+}
+
+// trace runs debug_traceCall with the call tracer and flattens the call tree
+// into one line per call, naming methods known from the loaded ABIs
+func (m *TxManager) trace(ctx context.Context, message ethereum.CallMsg, block string) []string {
+	var frame chainTraceFrame
+	err := m.client.Do(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		return client.Client().CallContext(ctx, &frame, "debug_traceCall", J{
+			"from": message.From.String(),
+			"to":   message.To.String(),
+			"data": hexutil.Encode(message.Data),
+		}, block, J{"tracer": "callTracer"})
+	})
+	if err != nil {
+		return []string{"trace unavailable: " + err.Error()}
+	}
+	lines := []string{}
+	var walk func(f chainTraceFrame, depth int)
+	walk = func(f chainTraceFrame, depth int) {
+		line := fmt.Sprintf("%s%s %s %s gas=%d", strings.Repeat("  ", depth), f.Type, f.To, chainSelectorName(f.Input), f.GasUsed)
+		if f.RevertReason != "" {
+			line += " reverted: " + f.RevertReason
+		} else if f.Error != "" {
+			line += " error: " + f.Error
+		}
+		lines = append(lines, line)
+		for _, child := range f.Calls {
+			walk(child, depth+1)
+		}
+	}
+	walk(frame, 0)
+	return lines
+}
+
+// chainSelectorName names the method called by the given call data if its
+// selector is in a loaded ABI, else returns the raw selector
+func chainSelectorName(input string) string {
+	data, err := hexutil.Decode(input)
+	if err != nil || len(data) < 4 {
+		return ""
+	}
+	var id [4]byte
+	copy(id[:], data[:4])
+	if sig, ok := contractSelectors[id]; ok {
+		return sig
+	}
+	return hexutil.Encode(data[:4])
+}
+
+// formatChainArgs renders call arguments as "type name=value" strings
+func formatChainArgs(inputs abi.Arguments, args []interface{}) pq.StringArray {
+	formatted := pq.StringArray{}
+	for i, a := range args {
+		prefix := ""
+		if i < len(inputs) {
+			prefix = inputs[i].Type.String() + " "
+			if inputs[i].Name != "" {
+				prefix += inputs[i].Name + "="
+			}
+		}
+		var value string
+		switch v := a.(type) {
+		case []byte:
+			value = hexutil.Encode(v)
+		case common.Address:
+			value = v.Hex()
+		case *big.Int:
+			value = v.String()
+		default:
+			bs, err := json.Marshal(v)
+			if err != nil {
+				value = fmt.Sprintf("%v", v)
+			} else {
+				value = string(bs)
+			}
+		}
+		formatted = append(formatted, prefix+value)
+	}
+	return formatted
+}
@@ -0,0 +1,505 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/lib/pq"
+)
+
+const (
+	ChainTxPending  = "pending"
+	ChainTxMined    = "mined"
+	ChainTxReverted = "reverted"
+	ChainTxDropped  = "dropped"
+	ChainTxSkipped  = "skipped"
+	// ChainTxStuck is a transaction still pending at MaxFeeCap. It isn't sped up
+	// anymore but is followed till it's mined or dropped.
+	ChainTxStuck = "stuck"
+)
+
+// ChainTx is a transaction sent by a TxManager, persisted in app_txs. Hash is
+// the latest broadcast hash, Hashes all the ones sent for this nonce (speed ups)
+type ChainTx struct {
+	ID          string
+	ChainID     int64
+	Label       string
+	FromAddress string
+	ToAddress   string
+	Data        string
+	Nonce       int64
+	Gas         int64
+	GasTipCap   *BigInt
+	GasFeeCap   *BigInt
+	Hash        string
+	Hashes      pq.StringArray
+	Status      string
+	BlockNumber int64
+	GasUsed     int64
+	Error       string
+	Created     time.Time
+	Updated     time.Time
+}
+
+func (tx *ChainTx) TableName() string { return "app_txs" }
+
+// Done tells if the transaction won't change status anymore
+func (tx *ChainTx) Done() bool {
+	return tx.Status != ChainTxPending && tx.Status != ChainTxStuck
+}
+
+// TxManager sends write transactions for a ChainClient's wallet: it prices them
+// from recent blocks, hands out nonces locally, records them in app_txs and
+// follows them until mined, replacing stuck ones with higher fees.
+// Nonces are tracked per process, only one process should send from a wallet.
+type TxManager struct {
+	client *ChainClient
+	db     *Database
+
+	// BumpAfter is how long a transaction can stay pending before being sped up
+	BumpAfter time.Duration
+	// BumpPercent is how much fees are raised by on each speed up (nodes require at least 10)
+	BumpPercent int64
+	// MaxFeeCap is the most we are willing to pay per gas, nil for no limit
+	MaxFeeCap *BigInt
+	// DropAfter is how long the nonce of a transaction must be seen used, with
+	// none of its hashes mined, before it's considered dropped. Endpoints lag
+	// each other so a receipt can be missing from one that has the new nonce.
+	DropAfter time.Duration
+
+	mu          sync.Mutex
+	nonce       uint64
+	nonceLoaded bool
+	// nonceUsed is when each pending tx's nonce was first seen used without a receipt
+	nonceUsed sync.Map
+}
+
+// NewTxManager creates a transaction manager for the client's wallet and attaches it to the client
+func NewTxManager(db *Database, client *ChainClient) *TxManager {
+	m := &TxManager{client: client, db: db}
+	m.BumpAfter = time.Duration(StringToInt(Env("TX_BUMP_AFTER_S", "120"))) * time.Second
+	m.BumpPercent = StringToInt(Env("TX_BUMP_PERCENT", "20"))
+	m.DropAfter = time.Duration(StringToInt(Env("TX_DROP_AFTER_S", "60"))) * time.Second
+	if max := Env("TX_MAX_FEE_GWEI", ""); max != "" {
+		m.MaxFeeCap = Bn(StringToInt(max), 9)
+	}
+	client.Txs = m
+	return m
+}
+
+// Send sends a write call using the same "name-inputs-outputs" function string as ChainClient.Call
+func (m *TxManager) Send(ctx context.Context, to string, fn string, args ...interface{}) (*ChainTx, error) {
+	method, _ := parseFn(strings.TrimPrefix(fn, "+"))
+	data, err := packFn(method, chainArgs(method.Inputs, args))
+	if err != nil {
+		return nil, fmt.Errorf("chain: packing %s %s: %w", to, fn, err)
+	}
+	return m.send(ctx, to, fn, data)
+}
+
+// SendMethod sends a write call to a registered contract method
+func (m *TxManager) SendMethod(ctx context.Context, cm *ContractMethod, to string, args ...interface{}) (*ChainTx, error) {
+	data, err := cm.Pack(args...)
+	if err != nil {
+		return nil, err
+	}
+	return m.send(ctx, to, cm.Contract+"."+cm.Name, data)
+}
+
+func (m *TxManager) send(ctx context.Context, to string, label string, data []byte) (*ChainTx, error) {
+	c := m.client
+	bto := common.HexToAddress(to)
+	message := ethereum.CallMsg{From: c.WalletAddress, To: &bto, Data: data}
+
+	var gas uint64
+	err := c.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+		gas, err = client.EstimateGas(ctx, message)
+		return err
+	})
+	if err != nil {
+		Log("error", "tx gas estimate failed", J{"to": to, "label": label, "error": err.Error(), "trace": m.trace(ctx, message, "latest")})
+		return nil, fmt.Errorf("error estimating gas: %w", newChainCallError(to, label, err))
+	}
+	tip, feeCap, err := m.SuggestFees(ctx)
+	if err != nil {
+		return nil, newChainCallError(to, label, err)
+	}
+
+	tx := &ChainTx{
+		ID:          NewID(),
+		ChainID:     c.ChainID.Int64(),
+		Label:       label,
+		FromAddress: c.WalletAddress.String(),
+		ToAddress:   bto.String(),
+		Data:        hexutil.Encode(data),
+		Gas:         int64(gas),
+		GasTipCap:   tip,
+		GasFeeCap:   feeCap,
+		Hashes:      pq.StringArray{},
+		Status:      ChainTxPending,
+		Created:     time.Now(),
+	}
+	if !IsProduction() {
+		tx.Status = ChainTxSkipped
+		if _, err := m.sign(ctx, tx); err != nil {
+			return nil, err
+		}
+		return tx, m.save(tx)
+	}
+
+	// Hold the nonce lock until broadcast so nonces go out in order
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nonce, err := m.nextNonce(ctx)
+	if err != nil {
+		return nil, newChainCallError(to, label, err)
+	}
+	tx.Nonce = int64(nonce)
+	signed, err := m.sign(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	// Saved before it's broadcast, a failure to record it must not lead the
+	// caller to retry and send it twice
+	if err := m.save(tx); err != nil {
+		return nil, err
+	}
+	if err := m.broadcast(ctx, signed); err != nil {
+		if isEndpointError(ctx, err) {
+			// It may have gone out anyway, it's followed like any pending tx and
+			// resent by its next speed up if not
+			Log("warning", "tx broadcast failed, following it", J{"id": tx.ID, "hash": tx.Hash, "error": err.Error()})
+			m.nonce++
+			return tx, nil
+		}
+		if strings.Contains(err.Error(), "nonce") {
+			// Someone else used the wallet, resync on next send
+			m.nonceLoaded = false
+		}
+		tx.Status = ChainTxDropped
+		tx.Error = err.Error()
+		if err := m.save(tx); err != nil {
+			Log("error", "tx not broadcast, saving its status failed", J{"id": tx.ID, "error": err.Error()})
+		}
+		return nil, newChainCallError(to, label, err)
+	}
+	m.nonce++
+	return tx, nil
+}
+
+// nextNonce must be called with the lock held
+func (m *TxManager) nextNonce(ctx context.Context) (uint64, error) {
+	if m.nonceLoaded {
+		return m.nonce, nil
+	}
+	var nonce uint64
+	err := m.client.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+		nonce, err = client.PendingNonceAt(ctx, m.client.WalletAddress)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Our own pending txs may not have reached the endpoint's mempool yet
+	var last struct{ Nonce *int64 }
+	err = m.db.FirstErr(&last, `select max(nonce) as nonce from app_txs where chain_id = $1 and from_address = $2 and status in ($3, $4)`,
+		m.client.ChainID.Int64(), m.client.WalletAddress.String(), ChainTxPending, ChainTxStuck)
+	if err != nil {
+		return 0, err
+	}
+	if last.Nonce != nil && uint64(*last.Nonce) >= nonce {
+		nonce = uint64(*last.Nonce) + 1
+	}
+	m.nonce = nonce
+	m.nonceLoaded = true
+	return nonce, nil
+}
+
+// sign signs the transaction at its current fees, setting its hash and adding it to Hashes
+func (m *TxManager) sign(ctx context.Context, tx *ChainTx) (*types.Transaction, error) {
+	if m.client.Signer == nil {
+		return nil, ErrNoSigner
+	}
+	to := common.HexToAddress(tx.ToAddress)
+	signed, err := m.client.Signer.SignTx(ctx, types.NewTx(&types.DynamicFeeTx{
+		ChainID:   m.client.ChainID,
+		Nonce:     uint64(tx.Nonce),
+		GasTipCap: tx.GasTipCap.Std(),
+		GasFeeCap: tx.GasFeeCap.Std(),
+		Gas:       uint64(tx.Gas),
+		To:        &to,
+		Data:      hexutil.MustDecode(tx.Data),
+	}), m.client.ChainID)
+	if err != nil {
+		return nil, err
+	}
+	tx.Hash = signed.Hash().Hex()
+	tx.Hashes = append(tx.Hashes, tx.Hash)
+	return signed, nil
+}
+
+func (m *TxManager) broadcast(ctx context.Context, signed *types.Transaction) error {
+	// Resending the same signed tx to another endpoint is harmless, worst case it's "already known"
+	err := m.client.Do(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		err := client.SendTransaction(ctx, signed)
+		if err != nil && strings.Contains(err.Error(), "already known") {
+			// Not the endpoint's fault, don't fail over
+			return nil
+		}
+		return err
+	})
+	return err
+}
+
+func (m *TxManager) save(tx *ChainTx) error {
+	return m.saveIn(m.db, tx)
+}
+
+func (m *TxManager) saveIn(db *Database, tx *ChainTx) error {
+	// Postgres keeps microseconds, truncate so the value we hold matches the row
+	tx.Updated = time.Now().Truncate(time.Microsecond)
+	return db.ExecuteErr(`insert into app_txs (id, chain_id, label, from_address, to_address, data, nonce, gas, gas_tip_cap, gas_fee_cap, hash, hashes, status, block_number, gas_used, error, created, updated)
+values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+on conflict (id) do update set gas_tip_cap = $9, gas_fee_cap = $10, hash = $11, hashes = $12, status = $13, block_number = $14, gas_used = $15, error = $16, updated = $18`,
+		tx.ID, tx.ChainID, tx.Label, tx.FromAddress, tx.ToAddress, tx.Data, tx.Nonce, tx.Gas, tx.GasTipCap, tx.GasFeeCap,
+		tx.Hash, tx.Hashes, tx.Status, tx.BlockNumber, tx.GasUsed, tx.Error, tx.Created, tx.Updated)
+}
+
+// SuggestFees prices a transaction from the last 10 blocks: the tip is the median
+// tip paid and the fee cap leaves room for the base fee to double
+func (m *TxManager) SuggestFees(ctx context.Context) (*BigInt, *BigInt, error) {
+	var history *ethereum.FeeHistory
+	err := m.client.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+		history, err = client.FeeHistory(ctx, 10, nil, []float64{50})
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(history.BaseFee) == 0 {
+		return nil, nil, errors.New("TxManager: empty fee history")
+	}
+	rewards := []*big.Int{}
+	for _, r := range history.Reward {
+		if len(r) > 0 && r[0] != nil {
+			rewards = append(rewards, r[0])
+		}
+	}
+	tip := Bn(1, 0)
+	if len(rewards) > 0 {
+		sort.Slice(rewards, func(i, j int) bool { return rewards[i].Cmp(rewards[j]) < 0 })
+		if median := Bnw(rewards[len(rewards)/2]); median.Gt(tip) {
+			tip = median
+		}
+	}
+	// The last base fee is the one for the next block
+	baseFee := Bnw(history.BaseFee[len(history.BaseFee)-1])
+	feeCap := baseFee.Mul(Bn(2, 0)).Add(tip)
+	if m.MaxFeeCap != nil && feeCap.Gt(m.MaxFeeCap) {
+		feeCap = m.MaxFeeCap
+		if tip.Gt(feeCap) {
+			tip = feeCap
+		}
+	}
+	return tip, feeCap, nil
+}
+
+// Wait follows the transaction until it's no longer pending or ctx is done,
+// speeding it up when it stays pending for longer than BumpAfter. A stuck
+// transaction is returned as an error, it's left for CheckPending to follow.
+func (m *TxManager) Wait(ctx context.Context, tx *ChainTx) error {
+	for !tx.Done() {
+		if err := m.Check(ctx, tx); err != nil {
+			return err
+		}
+		if tx.Done() {
+			break
+		}
+		if tx.Status == ChainTxStuck {
+			return &ChainError{Kind: ChainErrorRPC, To: tx.ToAddress, Fn: tx.Label, Err: errors.New("transaction stuck at max fee")}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+	if tx.Status == ChainTxReverted {
+		return &ChainError{Kind: ChainErrorRevert, To: tx.ToAddress, Fn: tx.Label, Reason: tx.Error, Err: errors.New("transaction " + tx.Status)}
+	}
+	if tx.Status == ChainTxDropped {
+		return &ChainError{Kind: ChainErrorDropped, To: tx.ToAddress, Fn: tx.Label, Err: errors.New("transaction dropped: " + tx.Error)}
+	}
+	return nil
+}
+
+// Check looks for a receipt for any of the hashes sent for the transaction and
+// updates its status, replacing it with higher fees if it has been stuck for too long
+func (m *TxManager) Check(ctx context.Context, tx *ChainTx) error {
+	if tx.Done() {
+		return nil
+	}
+	c := m.client
+	if mined, err := m.checkReceipts(ctx, tx); err != nil || mined {
+		return err
+	}
+
+	// No receipt and the nonce has been used: another tx took its place, unless
+	// the endpoint we asked for receipts is behind the one that gave the nonce
+	var nonce uint64
+	err := c.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+		nonce, err = client.NonceAt(ctx, common.HexToAddress(tx.FromAddress), nil)
+		return err
+	})
+	if err != nil {
+		return newChainCallError(tx.ToAddress, tx.Label, err)
+	}
+	if nonce > uint64(tx.Nonce) {
+		if mined, err := m.checkReceipts(ctx, tx); err != nil || mined {
+			return err
+		}
+		first, _ := m.nonceUsed.LoadOrStore(tx.ID, time.Now())
+		if time.Since(first.(time.Time)) < m.DropAfter {
+			return nil
+		}
+		m.nonceUsed.Delete(tx.ID)
+		tx.Status = ChainTxDropped
+		tx.Error = "nonce used by another transaction"
+		return m.save(tx)
+	}
+
+	if tx.Status == ChainTxPending && time.Since(tx.Updated) > m.BumpAfter {
+		return m.speedUp(ctx, tx)
+	}
+	return nil
+}
+
+// checkReceipts looks for a receipt for any of the hashes sent for the
+// transaction, updating it and returning true if one was mined
+func (m *TxManager) checkReceipts(ctx context.Context, tx *ChainTx) (bool, error) {
+	for _, hash := range tx.Hashes {
+		var receipt *types.Receipt
+		err := m.client.Do(ctx, func(ctx context.Context, client *ethclient.Client) (err error) {
+			receipt, err = client.TransactionReceipt(ctx, common.HexToHash(hash))
+			if errors.Is(err, ethereum.NotFound) {
+				// Not mined isn't the endpoint's fault, don't fail over
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return false, newChainCallError(tx.ToAddress, tx.Label, err)
+		}
+		if receipt == nil {
+			continue
+		}
+		m.nonceUsed.Delete(tx.ID)
+		tx.Hash = hash
+		tx.BlockNumber = receipt.BlockNumber.Int64()
+		tx.GasUsed = int64(receipt.GasUsed)
+		tx.Status = ChainTxMined
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			tx.Status = ChainTxReverted
+		}
+		return true, m.save(tx)
+	}
+	return false, nil
+}
+
+// speedUp resends the transaction with the same nonce and fees raised by at
+// least BumpPercent, or the current suggestion if the market moved more than
+// that. Fees are capped at MaxFeeCap, once sent at it the transaction is marked
+// stuck rather than sped up again. As the sender's Wait and the chain-txs job
+// can both get to it, the replacement is signed first and only saved (then
+// broadcast) if the row still has the hash we started from, under a row lock
+// held just for that: the one coming second picks up the new hash instead.
+func (m *TxManager) speedUp(ctx context.Context, tx *ChainTx) error {
+	tip, feeCap, err := m.SuggestFees(ctx)
+	if err != nil {
+		return newChainCallError(tx.ToAddress, tx.Label, err)
+	}
+	bump := func(v *BigInt) *BigInt {
+		return v.Mul(Bn(100+m.BumpPercent, 0)).Div(Bn(100, 0)).Add(Bn(1, 0))
+	}
+	if b := bump(tx.GasTipCap); b.Gt(tip) {
+		tip = b
+	}
+	if b := bump(tx.GasFeeCap); b.Gt(feeCap) {
+		feeCap = b
+	}
+	next := *tx
+	next.Hashes = append(pq.StringArray{}, tx.Hashes...)
+	var signed *types.Transaction
+	if m.MaxFeeCap != nil && feeCap.Gt(m.MaxFeeCap) && !tx.GasFeeCap.Lt(m.MaxFeeCap) {
+		next.Status = ChainTxStuck
+	} else {
+		if m.MaxFeeCap != nil && feeCap.Gt(m.MaxFeeCap) {
+			feeCap = m.MaxFeeCap
+		}
+		if tip.Gt(feeCap) {
+			tip = feeCap
+		}
+		next.GasTipCap = tip
+		next.GasFeeCap = feeCap
+		if signed, err = m.sign(ctx, &next); err != nil {
+			return err
+		}
+	}
+
+	replaced := false
+	err = m.db.Tx(func(db *Database) error {
+		current := &ChainTx{}
+		if err := db.MustFirstWhereForUpdateErr(current, "id = $1", tx.ID); err != nil {
+			return err
+		}
+		if current.Done() || current.Hash != tx.Hash || current.Status != tx.Status {
+			replaced = true
+			*tx = *current
+			return nil
+		}
+		// Kept even if the broadcast fails, it may have reached a node anyway and
+		// following a hash that's never mined is harmless
+		return m.saveIn(db, &next)
+	})
+	if err != nil || replaced {
+		return err
+	}
+	previous := tx.Hash
+	*tx = next
+	if signed == nil {
+		Log("error", "tx stuck at max fee", J{"id": tx.ID, "hash": tx.Hash, "label": tx.Label, "nonce": tx.Nonce})
+		return nil
+	}
+	if err := m.broadcast(ctx, signed); err != nil {
+		return newChainCallError(tx.ToAddress, tx.Label, err)
+	}
+	LogInfo("tx sped up", J{"id": tx.ID, "previous": previous, "hash": tx.Hash, "feeCap": feeCap.String()})
+	return nil
+}
+
+// CheckPending checks all pending transactions sent from this manager's wallet
+func (m *TxManager) CheckPending(ctx context.Context) error {
+	txs := []*ChainTx{}
+	err := m.db.AllErr(&txs, `select * from app_txs where chain_id = $1 and from_address = $2 and status in ($3, $4) order by nonce`,
+		m.client.ChainID.Int64(), m.client.WalletAddress.String(), ChainTxPending, ChainTxStuck)
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		if err := m.Check(ctx, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// ContractMethod is a typed binding to a method from a Foundry build artifact.
+// Bindings are registered at init and resolved against the ABIs in `out/` when
+// the server starts so that a wrong method name or result type fails early.
+type ContractMethod struct {
+	Contract string
+	Name     string
+	Method   abi.Method
+	result   reflect.Type
+	fields   []int
+	tuple    bool
+}
+
+var globalContractMethods = []*ContractMethod{}
+
+// contractSelectors maps method selectors from loaded ABIs to their signature to name calls in traces
+var contractSelectors = map[[4]byte]string{}
+
+// RegisterContractMethod binds a method of a contract artifact to a result type.
+// The contract is either a name ("Investor" for out/Investor.sol/Investor.json) or
+// a path relative to out/ ("Investor.sol/IOracle"). The method is either a name or
+// a full signature ("file(bytes32,address)") for overloaded methods. The result
+// is a zero value of the type calls will decode into: a struct with one field per
+// output (or tuple component), or a single value for methods with one output.
+func RegisterContractMethod(contract, method string, result interface{}) *ContractMethod {
+	m := &ContractMethod{Contract: contract, Name: method, result: reflect.TypeOf(result)}
+	globalContractMethods = append(globalContractMethods, m)
+	return m
+}
+
+// LoadContracts reads the ABIs for all registered contract methods from the
+// Foundry artifacts in `out/` and checks result types against them
+func LoadContracts(fsys fs.FS) {
+	abis := map[string]*abi.ABI{}
+	for _, m := range globalContractMethods {
+		path := m.Contract
+		if !strings.Contains(path, "/") {
+			path = path + ".sol/" + path
+		}
+		a, ok := abis[path]
+		if !ok {
+			bs, err := fs.ReadFile(fsys, "out/"+path+".json")
+			if err != nil {
+				panic(fmt.Errorf("LoadContracts: reading artifact for %s: %w", m.Contract, err))
+			}
+			artifact := struct{ Abi json.RawMessage }{}
+			Check(json.Unmarshal(bs, &artifact))
+			parsed, err := abi.JSON(bytes.NewReader(artifact.Abi))
+			if err != nil {
+				panic(fmt.Errorf("LoadContracts: parsing abi for %s: %w", m.Contract, err))
+			}
+			a = &parsed
+			for _, method := range parsed.Methods {
+				var id [4]byte
+				copy(id[:], method.ID[:4])
+				contractSelectors[id] = method.Sig
+			}
+			for _, e := range parsed.Errors {
+				var id [4]byte
+				copy(id[:], e.ID[:4])
+				contractErrors[id] = e
+			}
+			abis[path] = a
+		}
+		Check(m.resolve(a))
+	}
+}
+
+func (m *ContractMethod) resolve(a *abi.ABI) error {
+	found := false
+	for _, method := range a.Methods {
+		if method.RawName == m.Name || method.Sig == m.Name {
+			if found {
+				return fmt.Errorf("ContractMethod: %s.%s is overloaded, use the full signature", m.Contract, m.Name)
+			}
+			m.Method = method
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("ContractMethod: %s has no method %s", m.Contract, m.Name)
+	}
+
+	outputs := m.Method.Outputs
+	m.tuple = len(outputs) == 1 && outputs[0].Type.T == abi.TupleTy
+	if m.result == nil {
+		if len(outputs) > 0 {
+			return fmt.Errorf("ContractMethod: %s.%s has outputs but no result type", m.Contract, m.Name)
+		}
+		return nil
+	}
+	if len(outputs) == 1 && !m.tuple {
+		if !chainConvertible(outputs[0].Type.GetType(), m.result) {
+			return fmt.Errorf("ContractMethod: %s.%s returns %s, can't decode into %s",
+				m.Contract, m.Name, outputs[0].Type.String(), m.result)
+		}
+		return nil
+	}
+	if m.result.Kind() != reflect.Struct {
+		return fmt.Errorf("ContractMethod: %s.%s has multiple outputs, result must be a struct not %s",
+			m.Contract, m.Name, m.result)
+	}
+
+	names := []string{}
+	types := []reflect.Type{}
+	if m.tuple {
+		names = outputs[0].Type.TupleRawNames
+		for _, t := range outputs[0].Type.TupleElems {
+			types = append(types, t.GetType())
+		}
+	} else {
+		for _, o := range outputs {
+			names = append(names, o.Name)
+			types = append(types, o.Type.GetType())
+		}
+	}
+	if len(names) != m.result.NumField() {
+		return fmt.Errorf("ContractMethod: %s.%s has %d outputs but %s has %d fields",
+			m.Contract, m.Name, len(names), m.result, m.result.NumField())
+	}
+	m.fields = []int{}
+	for i, name := range names {
+		index := i
+		if name != "" {
+			field, ok := m.result.FieldByName(abi.ToCamelCase(name))
+			if !ok {
+				return fmt.Errorf("ContractMethod: %s.%s output %s has no field in %s",
+					m.Contract, m.Name, name, m.result)
+			}
+			index = field.Index[0]
+		}
+		if !chainConvertible(types[i], m.result.Field(index).Type) {
+			return fmt.Errorf("ContractMethod: %s.%s output %d is %s, can't decode into %s.%s",
+				m.Contract, m.Name, i, types[i], m.result, m.result.Field(index).Name)
+		}
+		m.fields = append(m.fields, index)
+	}
+	return nil
+}
+
+// Pack encodes the call data for this method with the given arguments
+func (m *ContractMethod) Pack(args ...interface{}) ([]byte, error) {
+	if m.Method.ID == nil {
+		return nil, fmt.Errorf("ContractMethod: %s.%s used before LoadContracts", m.Contract, m.Name)
+	}
+	data, err := packFn(m.Method, chainArgs(m.Method.Inputs, args))
+	if err != nil {
+		return nil, fmt.Errorf("ContractMethod: %s.%s: %w", m.Contract, m.Name, err)
+	}
+	return data, nil
+}
+
+// Unpack decodes call return data into result, which must be a pointer to the
+// type this method was registered with
+func (m *ContractMethod) Unpack(result interface{}, data []byte) error {
+	values, err := m.Method.Outputs.Unpack(data)
+	if err != nil {
+		return fmt.Errorf("ContractMethod: %s.%s: %w", m.Contract, m.Name, err)
+	}
+	if result == nil || len(values) == 0 {
+		return nil
+	}
+	dst := reflect.ValueOf(result)
+	if dst.Kind() != reflect.Ptr || dst.Elem().Type() != m.result {
+		return fmt.Errorf("ContractMethod: %s.%s: result must be *%s not %T", m.Contract, m.Name, m.result, result)
+	}
+	dst = dst.Elem()
+	if m.fields == nil {
+		dst.Set(chainConvert(reflect.ValueOf(values[0]), m.result))
+		return nil
+	}
+	src := []reflect.Value{}
+	if m.tuple {
+		tuple := reflect.ValueOf(values[0])
+		for i := 0; i < tuple.NumField(); i++ {
+			src = append(src, tuple.Field(i))
+		}
+	} else {
+		for _, v := range values {
+			src = append(src, reflect.ValueOf(v))
+		}
+	}
+	for i, index := range m.fields {
+		field := dst.Field(index)
+		field.Set(chainConvert(src[i], field.Type()))
+	}
+	return nil
+}
+
+// chainConvertible reports whether decoded abi values of type src can be stored
+// in dst without losing anything: the same type, a wider integer, or a type with
+// the same underlying one (*big.Int to *BigInt, [20]byte to common.Address),
+// inside slices too
+func chainConvertible(src, dst reflect.Type) bool {
+	if src == dst {
+		return true
+	}
+	if src.Kind() == reflect.Slice && dst.Kind() == reflect.Slice {
+		return chainConvertible(src.Elem(), dst.Elem())
+	}
+	if chainIntegerKinds[src.Kind()] && chainIntegerKinds[dst.Kind()] {
+		signed := func(k reflect.Kind) bool { return k >= reflect.Int && k <= reflect.Int64 }
+		if signed(src.Kind()) && !signed(dst.Kind()) {
+			return false
+		}
+		if signed(src.Kind()) == signed(dst.Kind()) {
+			return dst.Bits() >= src.Bits()
+		}
+		// Unsigned into signed needs a spare bit for the sign
+		return dst.Bits() > src.Bits()
+	}
+	switch src.Kind() {
+	case reflect.Ptr, reflect.Array, reflect.Struct:
+		// Conversions between these need identical underlying types
+		return src.Kind() == dst.Kind() && src.ConvertibleTo(dst)
+	}
+	return false
+}
+
+var chainIntegerKinds = map[reflect.Kind]bool{
+	reflect.Int: true, reflect.Int8: true, reflect.Int16: true, reflect.Int32: true, reflect.Int64: true,
+	reflect.Uint: true, reflect.Uint8: true, reflect.Uint16: true, reflect.Uint32: true, reflect.Uint64: true,
+}
+
+func chainConvert(v reflect.Value, t reflect.Type) reflect.Value {
+	if v.Kind() == reflect.Slice && t.Kind() == reflect.Slice && v.Type() != t {
+		s := reflect.MakeSlice(t, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s.Index(i).Set(chainConvert(v.Index(i), t.Elem()))
+		}
+		return s
+	}
+	return v.Convert(t)
+}
+
+// chainArgs converts the loose argument types used around the app (hex strings
+// for addresses and bytes, *BigInt for numbers) to what the abi package expects
+func chainArgs(inputs abi.Arguments, args []interface{}) []interface{} {
+	converted := make([]interface{}, len(args))
+	copy(converted, args)
+	for j, input := range inputs {
+		if j >= len(converted) {
+			break
+		}
+		switch input.Type.T {
+		case abi.AddressTy:
+			if a, ok := converted[j].(string); ok {
+				converted[j] = common.HexToAddress(a)
+			}
+		case abi.BytesTy:
+			if b, ok := converted[j].(string); ok {
+				converted[j] = hexutil.MustDecode(b)
+			}
+		case abi.UintTy, abi.IntTy:
+			if n, ok := converted[j].(*BigInt); ok {
+				converted[j] = n.Std()
+			}
+		}
+	}
+	return converted
+}
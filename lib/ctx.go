@@ -2,6 +2,9 @@ package lib
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -10,6 +13,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ses"
@@ -29,6 +33,9 @@ type Ctx struct {
 	Code   int
 	Data   J
 	params url.Values
+	ctx    context.Context
+	// dbRoot is DB before BeginTx switched it to a transaction
+	dbRoot *Database
 
 	// Tracing
 	tracingSpanID   string
@@ -52,6 +59,60 @@ func NewCtx(server *Server) *Ctx {
 	return ctx
 }
 
+// Context returns the request's context (cancelled when the client goes away) or,
+// for jobs, one cancelled when the queue gives up waiting for them on shutdown.
+// Within RunExclusive it's also cancelled when the lock is lost.
+func (c *Ctx) Context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	if c.Req != nil {
+		return c.Req.Context()
+	}
+	return context.Background()
+}
+
+// BeginTx switches c.DB to a transaction for the rest of the request. It's
+// committed by Render, JSON, Text or Redirect before they write a response
+// with a code under 500, so clients never see writes that end up rolled back,
+// and rolled back otherwise or on panic. Statements after the response is
+// written run outside of it.
+func (c *Ctx) BeginTx() {
+	Check(c.BeginTxErr())
+}
+
+// BeginTxErr switches c.DB to a transaction for the rest of the request
+func (c *Ctx) BeginTxErr() error {
+	if c.dbRoot != nil {
+		return nil
+	}
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return err
+	}
+	c.dbRoot, c.DB = c.DB, tx
+	return nil
+}
+
+// EndTx commits or rolls back the transaction BeginTx started, switching c.DB back
+func (c *Ctx) EndTx(commit bool) error {
+	if c.dbRoot == nil {
+		return nil
+	}
+	tx := c.DB
+	c.DB, c.dbRoot = c.dbRoot, nil
+	if commit {
+		return tx.Commit()
+	}
+	return tx.Rollback()
+}
+
+// endTxForResponse ends the transaction BeginTx started before a response with
+// code is written, panicking if the commit fails so a 500 is sent instead
+func (c *Ctx) endTxForResponse(code int) {
+	Check(c.EndTx(code < 500))
+}
+
 // Params returns a map of all form and query params
 func (c *Ctx) Params() map[string]string {
 	c.Req.ParseForm()
@@ -126,6 +187,7 @@ func (c *Ctx) Redirect(url string, args ...interface{}) {
 	if len(args) > 0 {
 		url = fmt.Sprintf(url, args...)
 	}
+	c.endTxForResponse(302)
 	c.Code = 302
 	c.Res.Header().Set("Location", url)
 	c.Res.WriteHeader(302)
@@ -141,6 +203,7 @@ func (c *Ctx) Render(code int, template string, data J) {
 	}
 	b := bytes.NewBuffer(nil)
 	Check(c.Tpl.ExecuteTemplate(b, template, data))
+	c.endTxForResponse(code)
 	c.Code = code
 	c.Res.Header().Set("Content-Type", "text/html; charset=utf-8")
 	c.Res.WriteHeader(code)
@@ -149,6 +212,7 @@ func (c *Ctx) Render(code int, template string, data J) {
 
 // Text sends a text response to the client
 func (c *Ctx) Text(code int, text string) {
+	c.endTxForResponse(code)
 	c.Code = code
 	c.Res.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	c.Res.WriteHeader(code)
@@ -159,12 +223,36 @@ func (c *Ctx) Text(code int, text string) {
 func (c *Ctx) JSON(code int, data interface{}) {
 	bs, err := json.Marshal(data)
 	Check(err)
+	c.endTxForResponse(code)
 	c.Code = code
 	c.Res.Header().Set("Content-Type", "application/json; charset=utf-8")
 	c.Res.WriteHeader(code)
 	c.Res.Write(bs)
 }
 
+// JSONCached sends a JSON encoded response clients can cache for maxAge, tagged
+// with a hash of its content so they can revalidate it with If-None-Match
+func (c *Ctx) JSONCached(data interface{}, maxAge time.Duration) {
+	bs, err := json.Marshal(data)
+	Check(err)
+	c.endTxForResponse(200)
+	hash := sha256.Sum256(bs)
+	etag := `"` + hex.EncodeToString(hash[:16]) + `"`
+	c.Res.Header().Set("ETag", etag)
+	c.Res.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	for _, match := range strings.Split(c.Req.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "W/"+etag || match == "*" {
+			c.Code = 304
+			c.Res.WriteHeader(304)
+			return
+		}
+	}
+	c.Code = 200
+	c.Res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	c.Res.WriteHeader(200)
+	c.Res.Write(bs)
+}
+
 // SendEmail renders a template to HTML and sends it as an email using AWS SES
 // It uses the SES_ACCESS_KEY and SES_SECRET_KEY environment variables.
 // And send the email from the email in the EMAIL_FROM environment variable.
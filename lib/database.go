@@ -15,11 +15,29 @@ import (
 // a single entity when no entity matched the given parameters
 var ErrDatabaseNotFound = errors.New("Database: Can't find entity for given parameters")
 
-// Database represents a connection to a PostgreSQL database
+// Database represents a connection to a PostgreSQL database, or a
+// transaction on it when returned by Begin or passed to a Tx func
 type Database struct {
 	ctx  *Ctx
 	url  string
 	conn *sqlx.DB
+	tx   *sqlx.Tx
+	// depth is 0 for the transaction itself, then the level of the savepoint
+	depth int
+}
+
+// dbRunner is what sqlx.DB and sqlx.Tx have in common that we use
+type dbRunner interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Get(dest interface{}, query string, args ...interface{}) error
+	Select(dest interface{}, query string, args ...interface{}) error
+}
+
+func (db *Database) runner() dbRunner {
+	if db.tx != nil {
+		return db.tx
+	}
+	return db.conn
 }
 
 // NewDatabase setsup a connection to a PostgreSQL database
@@ -57,7 +75,7 @@ func (db *Database) Close() {
 }
 
 func (db *Database) WithCtx(ctx *Ctx) *Database {
-	return &Database{ctx: ctx, url: db.url, conn: db.conn}
+	return &Database{ctx: ctx, url: db.url, conn: db.conn, tx: db.tx, depth: db.depth}
 }
 
 // Connection returns the underlying sqlx connection
@@ -73,7 +91,7 @@ func (db *Database) Execute(query string, values ...interface{}) {
 // ExecuteErr simply runs a SQL statement without caring about the results
 func (db *Database) ExecuteErr(query string, values ...interface{}) error {
 	//Log("debug", "executing sql", J{"sql": query})
-	_, err := db.conn.Exec(query, values...)
+	_, err := db.runner().Exec(query, values...)
 	return err
 }
 
@@ -85,7 +103,7 @@ func (db *Database) First(result interface{}, query string, values ...interface{
 // FirstErr returns the first entity for the given SQL query. It must be passed a non-nil struct.
 func (db *Database) FirstErr(result interface{}, query string, values ...interface{}) error {
 	//Log("debug", "executing sql", J{"sql": query})
-	return replaceNotFoundError(db.conn.Get(result, query, values...))
+	return replaceNotFoundError(db.runner().Get(result, query, values...))
 }
 
 // All returns all entities for the given SQL query. It must be passed a non-nil pointer to array of struct.
@@ -96,7 +114,7 @@ func (db *Database) All(result interface{}, query string, values ...interface{})
 // AllErr returns all entities for the given SQL query. It must be passed a non-nil pointer to array of struct.
 func (db *Database) AllErr(result interface{}, query string, values ...interface{}) error {
 	//Log("debug", "executing sql", J{"sql": query})
-	return db.conn.Select(result, query, values...)
+	return db.runner().Select(result, query, values...)
 }
 
 // FirstWhere returns the first entity for the given SQL where condition. It must be passed a non-nil struct.
@@ -123,7 +141,7 @@ func (db *Database) MustFirstWhereErr(model interface{}, where string, values ..
 	table := tableNameFor(model)
 	sql := fmt.Sprintf("SELECT * FROM %s WHERE %s", table, where)
 	//Log("debug", "executing sql", J{"sql": sql})
-	return replaceNotFoundError(db.conn.Get(model, sql, values...))
+	return replaceNotFoundError(db.runner().Get(model, sql, values...))
 }
 
 // AllWhere returns all entities for the given SQL where condition. It must be passed a non-nil pointer to array of struct.
@@ -136,7 +154,35 @@ func (db *Database) AllWhereErr(result interface{}, where string, values ...inte
 	table := tableNameFor(result)
 	sql := fmt.Sprintf("SELECT * FROM %s WHERE %s", table, where)
 	//Log("debug", "executing sql", J{"sql": sql})
-	return db.conn.Select(result, sql, values...)
+	return db.runner().Select(result, sql, values...)
+}
+
+// MustFirstWhereForUpdate locks and returns the first entity for the given SQL where condition, till the end of the transaction.
+func (db *Database) MustFirstWhereForUpdate(model interface{}, where string, values ...interface{}) {
+	Check(db.MustFirstWhereForUpdateErr(model, where, values...))
+}
+
+// MustFirstWhereForUpdateErr locks and returns the first entity for the given SQL where condition, till the end of the transaction.
+func (db *Database) MustFirstWhereForUpdateErr(model interface{}, where string, values ...interface{}) error {
+	if db.tx == nil {
+		return errors.New("Database: FOR UPDATE outside of a transaction")
+	}
+	sql := fmt.Sprintf("SELECT * FROM %s WHERE %s FOR UPDATE", tableNameFor(model), where)
+	return replaceNotFoundError(db.tx.Get(model, sql, values...))
+}
+
+// AllWhereForUpdate locks and returns all entities for the given SQL where condition, till the end of the transaction.
+func (db *Database) AllWhereForUpdate(result interface{}, where string, values ...interface{}) {
+	Check(db.AllWhereForUpdateErr(result, where, values...))
+}
+
+// AllWhereForUpdateErr locks and returns all entities for the given SQL where condition, till the end of the transaction.
+func (db *Database) AllWhereForUpdateErr(result interface{}, where string, values ...interface{}) error {
+	if db.tx == nil {
+		return errors.New("Database: FOR UPDATE outside of a transaction")
+	}
+	sql := fmt.Sprintf("SELECT * FROM %s WHERE %s FOR UPDATE", tableNameFor(result), where)
+	return db.tx.Select(result, sql, values...)
 }
 
 // Put upserts the given entity into the database
@@ -159,7 +205,11 @@ func (db *Database) PutErr(model interface{}) error {
 	}
 	vt := v.Type()
 	for i := 0; i < vt.NumField(); i++ {
-		cols = append(cols, StringToSnakeCase(vt.Field(i).Name))
+		col, ok := columnName(vt.Field(i))
+		if !ok {
+			continue
+		}
+		cols = append(cols, col)
 		args = append(args, v.Field(i).Interface())
 	}
 
@@ -190,8 +240,87 @@ func (db *Database) DeleteErr(model interface{}) error {
 	return db.ExecuteErr(fmt.Sprintf("DELETE FROM %s WHERE id = $1", table), v.Field(0).Interface())
 }
 
+// Tx runs fn in a transaction, committed if it returns nil and rolled back if
+// it returns an error or panics (the panic goes on). Called on a transaction,
+// it runs fn in a savepoint so only fn's statements are rolled back.
+func (db *Database) Tx(fn func(tx *Database) error) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+		if err != nil {
+			if rerr := tx.Rollback(); rerr != nil {
+				Log("error", "Database: rollback", J{"error": rerr.Error()})
+			}
+			return
+		}
+		err = tx.Commit()
+	}()
+	return fn(tx)
+}
+
+// Begin starts a transaction (or a savepoint in one), returning a handle
+// running statements in it till Commit or Rollback
+func (db *Database) Begin() (*Database, error) {
+	if db.tx != nil {
+		tx := &Database{ctx: db.ctx, url: db.url, conn: db.conn, tx: db.tx, depth: db.depth + 1}
+		if _, err := db.tx.Exec(fmt.Sprintf("SAVEPOINT sp_%d", tx.depth)); err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+	sqlTx, err := db.conn.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &Database{ctx: db.ctx, url: db.url, conn: db.conn, tx: sqlTx}, nil
+}
+
+// Commit commits the transaction, or releases the savepoint
+func (db *Database) Commit() error {
+	if db.tx == nil {
+		return errors.New("Database: Commit outside of a transaction")
+	}
+	if db.depth > 0 {
+		_, err := db.tx.Exec(fmt.Sprintf("RELEASE SAVEPOINT sp_%d", db.depth))
+		return err
+	}
+	return db.tx.Commit()
+}
+
+// Rollback rolls the transaction, or the savepoint, back
+func (db *Database) Rollback() error {
+	if db.tx == nil {
+		return errors.New("Database: Rollback outside of a transaction")
+	}
+	if db.depth > 0 {
+		_, err := db.tx.Exec(fmt.Sprintf("ROLLBACK TO SAVEPOINT sp_%d", db.depth))
+		return err
+	}
+	return db.tx.Rollback()
+}
+
+// InTx returns whether statements run in a transaction
+func (db *Database) InTx() bool {
+	return db.tx != nil
+}
+
+// tableNameFor returns the table of a model, or of the elements of a slice of
+// them, from its TableName method if it has one
 func tableNameFor(model interface{}) string {
-	parts := strings.Split(fmt.Sprintf("%T", model), ".")
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if namer, ok := reflect.New(t).Interface().(TableNamer); ok {
+		return namer.TableName()
+	}
+	parts := strings.Split(t.Name(), ".")
 	parts = strings.Split(StringToSnakeCase(parts[len(parts)-1]), "_")
 	for i, v := range parts {
 		if v[len(v)-1] == 'y' {
@@ -1,6 +1,9 @@
 package lib
 
 import (
+	"encoding/json"
+	"net/url"
+	"sort"
 	"time"
 )
 
@@ -9,7 +12,7 @@ func handleAdminRunJob(c *Ctx) {
 		c.Text(403, "Missing valid admin secret")
 		return
 	}
-	c.Queue.RunJob(c.Param("name", ""), J{})
+	c.Queue.runRecorded(c.Context(), &Job{ID: NewID(), Name: c.Param("name", ""), Args: J{}})
 	c.Text(200, c.tracingTraceID)
 }
 
@@ -24,3 +27,103 @@ func handleAdminSignInAs(c *Ctx) {
 	c.SetCookie(SessionCookieName, sessionID)
 	c.Redirect(SessionSigninRedirect)
 }
+
+func handleAdminRPCHealth(c *Ctx) {
+	if c.Param("secret", "") != Env("ADMIN_SECRET", NewID()) {
+		c.Text(403, "Missing valid admin secret")
+		return
+	}
+	health := J{}
+	for id, client := range c.Server.ChainClients {
+		health[IntToString(id)] = client.Health()
+	}
+	c.JSON(200, health)
+}
+
+type adminJobsDepth struct {
+	Queue    string
+	Priority int64
+	Pending  int64
+	Running  int64
+	Oldest   time.Time
+}
+
+type adminJobsStat struct {
+	Name     string
+	Runs     int64
+	Failures int64
+	Avg      int64
+	P95      int64
+}
+
+// handleAdminJobs shows the queue depth, job stats over the last day and
+// recent runs (filtered by `name` or `status`), failures and dead jobs
+func handleAdminJobs(c *Ctx) {
+	if c.Param("secret", "") != Env("ADMIN_SECRET", NewID()) {
+		c.Text(403, "Missing valid admin secret")
+		return
+	}
+	renderAdminJobs(c, J{})
+}
+
+func renderAdminJobs(c *Ctx, data J) {
+	depth := []*adminJobsDepth{}
+	c.DB.All(&depth, `select queue, coalesce(priority, 0) priority, count(*) filter (where locked_until is null or locked_until < now()) pending,
+  count(*) filter (where locked_until >= now()) running, min(created) oldest from app_jobs group by 1, 2 order by 1, 2`)
+	stats := []*adminJobsStat{}
+	c.DB.All(&stats, `select name, count(*) runs, count(*) filter (where status = 'failed') failures, avg(duration)::bigint avg,
+  percentile_disc(0.95) within group (order by duration) p95 from app_job_runs
+  where started > now() - interval '1 day' and status <> 'running' group by 1 order by 1`)
+	runs := []*JobRun{}
+	c.DB.All(&runs, `select * from app_job_runs where ($1 = '' or name = $1) and ($2 = '' or status = $2) order by started desc limit 100`,
+		c.Param("name", ""), c.Param("status", ""))
+	failures := []*JobRun{}
+	c.DB.All(&failures, `select * from app_job_runs where status = 'failed' order by started desc limit 25`)
+	dead := []*JobDead{}
+	c.DB.All(&dead, `select * from app_jobs_dead order by failed desc limit 25`)
+	names := []string{}
+	for name := range jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data["secret"] = c.Param("secret", "")
+	data["depth"] = depth
+	data["stats"] = stats
+	data["runs"] = runs
+	data["failures"] = failures
+	data["dead"] = dead
+	data["names"] = names
+	data["name"] = c.Param("name", "")
+	data["status"] = c.Param("status", "")
+	c.Render(200, "other/jobs", data)
+}
+
+// handleAdminJobsEnqueue enqueues the job `name` with `args` given as a JSON object
+func handleAdminJobsEnqueue(c *Ctx) {
+	if c.Param("secret", "") != Env("ADMIN_SECRET", NewID()) {
+		c.Text(403, "Missing valid admin secret")
+		return
+	}
+	name := c.Param("job", "")
+	args := J{}
+	if raw := c.Param("args", ""); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &args); err != nil {
+			renderAdminJobs(c, J{"error": "Invalid JSON args: " + err.Error(), "job": name, "args": raw})
+			return
+		}
+	}
+	if jobs[name] == nil {
+		renderAdminJobs(c, J{"error": "No job named " + name, "job": name, "args": c.Param("args", "")})
+		return
+	}
+	priority := jobOptionsFor(name).Priority
+	if p := c.Param("priority", ""); p != "" {
+		priority = StringToInt(p)
+	}
+	// Double submits of the form enqueue the job once
+	encoded, _ := json.Marshal(args)
+	enqueued := c.Queue.EnqueueWith(name, args, EnqueueOpts{Priority: priority, UniqueKey: "admin:" + name + ":" + string(encoded), UniqueFor: 10 * time.Second})
+	Log("info", "admin enqueued job", J{"name": name, "args": args, "duplicate": !enqueued})
+	c.Redirect("/admin/jobs/?secret=%s", url.QueryEscape(c.Param("secret", "")))
+}
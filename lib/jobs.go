@@ -31,6 +31,32 @@ var _ = RegisterSchedule("cleanup", time.Hour)
 
 var _ = RegisterJob("cleanup", func(c *Ctx, args J) {
 	c.DB.Execute("delete from app_cache where expires < now()")
+	c.DB.Execute("delete from app_job_runs where started < now() - interval '30 days'")
+	c.DB.Execute("delete from app_job_keys where expires < now()")
+})
+
+var _ = RegisterSchedule("chain-txs", time.Minute)
+
+var _ = RegisterJob("chain-txs", func(c *Ctx, args J) {
+	for id, client := range c.Server.ChainClients {
+		if client.Txs == nil {
+			continue
+		}
+		if err := client.Txs.CheckPending(c.Context()); err != nil {
+			Log("error", "checking pending txs", J{"chain": id, "error": err.Error()})
+		}
+	}
+})
+
+// Moves jobs that failed all their attempts back to the queue, all of them or
+// the one with the `id` or all with the `name` given
+var _ = RegisterJob("jobs-requeue-dead", func(c *Ctx, args J) {
+	idOrName := args.Get("id")
+	if idOrName == "" {
+		idOrName = args.Get("name")
+	}
+	n := c.Queue.RequeueDead(idOrName)
+	fmt.Printf("requeued %d dead jobs\n", n)
 })
 
 var _ = RegisterJob("cache-clear", func(c *Ctx, args J) {
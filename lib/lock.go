@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// LockTTL is how long a lock is held for without being renewed, locks renew
+// themselves every third of it so it only runs out when their process died
+const LockTTL = time.Minute
+
+var ErrLockNotHeld = errors.New("lock not held")
+
+// Lock is a lease on a name in app_locks, held by one process at a time
+// across all nodes. Each acquisition gets a higher fencing token than the
+// last, so writes guarded by it can reject a holder that lost the lock
+// without noticing (paused past its TTL). Its Context is cancelled when
+// the lock is lost or released.
+type Lock struct {
+	Name string
+	TTL  time.Duration
+
+	db     *Database
+	owner  string
+	token  int64
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	done   chan struct{}
+}
+
+// NewLock creates a lock on name, with the default TTL if ttl is 0
+func NewLock(db *Database, name string, ttl time.Duration) *Lock {
+	if ttl <= 0 {
+		ttl = LockTTL
+	}
+	hostname, _ := os.Hostname()
+	return &Lock{Name: name, TTL: ttl, db: db, owner: fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), NewID()[:8])}
+}
+
+// TryLock acquires the lock if it's free or its holder's lease ran out,
+// returning false if someone else holds it
+func (l *Lock) TryLock(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.token != 0 {
+		return false, errors.New("Lock: " + l.Name + " already held by this lock")
+	}
+	acquired := time.Now()
+	tokens := []int64{}
+	err := l.db.conn.SelectContext(ctx, &tokens, `insert into app_locks (name, owner, token, expires) values ($1, $2, 1, now() + make_interval(secs => $3))
+on conflict (name) do update set owner = $2, token = app_locks.token + 1, expires = now() + make_interval(secs => $3)
+where app_locks.expires < now() returning token`, l.Name, l.owner, l.TTL.Seconds())
+	if err != nil || len(tokens) == 0 {
+		return false, err
+	}
+	l.token = tokens[0]
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	l.done = make(chan struct{})
+	go l.renew(l.token, l.done, acquired)
+	return true, nil
+}
+
+// Lock waits till it acquires the lock, or ctx is done
+func (l *Lock) Lock(ctx context.Context) error {
+	for {
+		ok, err := l.TryLock(ctx)
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// renew extends the lease while held, cancelling the lock's context if it
+// finds someone else took it, or if it couldn't renew it before it ran out
+// (as someone else could take it then). since is when the lease was last
+// extended, measured before the query so it's never later than the database's.
+func (l *Lock) renew(token int64, done chan struct{}, since time.Time) {
+	for {
+		wait := l.TTL / 3
+		if left := time.Until(since.Add(l.TTL)); left < wait {
+			wait = left
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+		start := time.Now()
+		ctx, cancel := context.WithDeadline(context.Background(), since.Add(l.TTL))
+		tokens := []int64{}
+		err := l.db.conn.SelectContext(ctx, &tokens, `update app_locks set expires = now() + make_interval(secs => $4) where name = $1 and owner = $2 and token = $3 returning token`,
+			l.Name, l.owner, token, l.TTL.Seconds())
+		cancel()
+		if err != nil && time.Since(since) < l.TTL {
+			// Try again while the lease hasn't run out
+			Log("error", "Lock: renewing", J{"name": l.Name, "error": err.Error()})
+			continue
+		}
+		if err != nil || len(tokens) == 0 {
+			data := J{"name": l.Name, "token": token}
+			if err != nil {
+				data["error"] = err.Error()
+			}
+			Log("error", "Lock: lost", data)
+			l.mu.Lock()
+			if l.token == token {
+				l.release()
+			}
+			l.mu.Unlock()
+			return
+		}
+		since = start
+	}
+}
+
+// Token is the fencing token of the current acquisition, 0 when not held
+func (l *Lock) Token() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.token
+}
+
+// Context is cancelled when the lock is lost or released
+func (l *Lock) Context() context.Context {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ctx == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	return l.ctx
+}
+
+// Check returns ErrLockNotHeld if the lock isn't held with our token anymore,
+// to call before side effects that can't be fenced like sending a tx
+func (l *Lock) Check(ctx context.Context) error {
+	token := l.Token()
+	held := []int64{}
+	err := l.db.conn.SelectContext(ctx, &held, `select token from app_locks where name = $1 and owner = $2 and token = $3 and expires > now()`,
+		l.Name, l.owner, token)
+	if err != nil {
+		return err
+	}
+	if token == 0 || len(held) == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// Unlock releases the lock. The row is kept, expired, so tokens keep increasing.
+func (l *Lock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.token == 0 {
+		return ErrLockNotHeld
+	}
+	token := l.token
+	l.release()
+	return l.db.ExecuteErr(`update app_locks set expires = now() - interval '1 second' where name = $1 and owner = $2 and token = $3`,
+		l.Name, l.owner, token)
+}
+
+func (l *Lock) release() {
+	l.token = 0
+	l.cancel()
+	close(l.done)
+}
+
+// RunExclusive runs fn if it can acquire the lock on name, returning whether
+// it did. The Ctx fn gets has a Context cancelled if the lock is lost, and
+// the lock in Data["lock"] for fencing.
+func (c *Ctx) RunExclusive(name string, fn func(c *Ctx)) bool {
+	ran, err := c.RunExclusiveErr(name, fn)
+	Check(err)
+	return ran
+}
+
+// CheckLock returns an error if the lock RunExclusive took was lost, to call
+// right before side effects another run mustn't repeat, like sending txs.
+// It's nil outside of RunExclusive.
+func (c *Ctx) CheckLock() error {
+	if lock, ok := c.Data["lock"].(*Lock); ok {
+		return lock.Check(c.Context())
+	}
+	return nil
+}
+
+// RunExclusiveErr runs fn if it can acquire the lock on name, returning whether it did
+func (c *Ctx) RunExclusiveErr(name string, fn func(c *Ctx)) (bool, error) {
+	lock := NewLock(c.Server.Database, name, LockTTL)
+	ok, err := lock.TryLock(c.Context())
+	if err != nil || !ok {
+		if err == nil {
+			Log("info", "RunExclusive: lock held elsewhere, skipping", J{"name": name})
+		}
+		return false, err
+	}
+	defer lock.Unlock()
+	locked := *c
+	locked.ctx = lock.Context()
+	locked.Data = J{}
+	for k, v := range c.Data {
+		locked.Data[k] = v
+	}
+	locked.Data["lock"] = lock
+	fn(&locked)
+	return true, nil
+}
+
+// Exclusive wraps a job so that only one process runs it (or any other job
+// using the same lock name) at a time, runs finding it held are skipped
+func Exclusive(name string, handler func(*Ctx, J)) func(*Ctx, J) {
+	return func(c *Ctx, args J) {
+		c.RunExclusive(name, func(c *Ctx) {
+			handler(c, args)
+		})
+	}
+}
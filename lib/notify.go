@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Notification is an alert meant for humans, about an address when Address is set
+type Notification struct {
+	Level   string
+	Title   string
+	Message string
+	Address string
+	Fields  J
+}
+
+// Notifier delivers notifications somewhere people will see them
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// NewNotifierFromEnv logs notifications and, when NOTIFY_WEBHOOK_URL is set
+// (comma separated for more than one), posts them to those webhooks too
+func NewNotifierFromEnv() Notifier {
+	notifiers := MultiNotifier{LogNotifier{}}
+	for _, url := range strings.Split(Env("NOTIFY_WEBHOOK_URL", ""), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			notifiers = append(notifiers, NewWebhookNotifier(url))
+		}
+	}
+	return notifiers
+}
+
+// LogNotifier writes notifications to the logs
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, n *Notification) error {
+	fields := J{"title": n.Title, "message": n.Message, "address": n.Address}
+	for k, v := range n.Fields {
+		fields[k] = v
+	}
+	level := "info"
+	if n.Level == "warning" || n.Level == "error" {
+		level = n.Level
+	}
+	Log(level, "notification", fields)
+	return nil
+}
+
+// MultiNotifier hands notifications to all its notifiers, returning the first error
+type MultiNotifier []Notifier
+
+func (m MultiNotifier) Notify(ctx context.Context, n *Notification) error {
+	var first error
+	for _, notifier := range m {
+		if err := notifier.Notify(ctx, n); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+var webhookColors = map[string]int{"info": 0x3b82f6, "warning": 0xf59e0b, "error": 0xef4444}
+
+// WebhookNotifier posts notifications as Discord style webhook messages (an
+// embed with the fields), which Slack compatible and custom endpoints accept too
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier creates a notifier posting to url
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n *Notification) error {
+	keys := []string{}
+	for k := range n.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := []J{}
+	if n.Address != "" {
+		fields = append(fields, J{"name": "address", "value": n.Address})
+	}
+	for _, k := range keys {
+		fields = append(fields, J{"name": k, "value": fmt.Sprintf("%v", n.Fields[k]), "inline": true})
+	}
+	bs, err := json.Marshal(J{
+		"content": fmt.Sprintf("[%s] %s", strings.ToUpper(n.Level), n.Title),
+		"embeds": []J{{
+			"title":       n.Title,
+			"description": n.Message,
+			"color":       webhookColors[n.Level],
+			"fields":      fields,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook notifier: %w", err)
+	}
+	defer resp.Body.Close()
+	// Discord answers 204 without a body, only the status matters
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook notifier: got status code %d (%s)", resp.StatusCode, body)
+	}
+	return nil
+}
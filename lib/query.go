@@ -0,0 +1,293 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TableNamer is implemented by models naming their table, others get the
+// plural of their type name (LeaderboardUser maps to leaderboards_users)
+type TableNamer interface {
+	TableName() string
+}
+
+// Query builds a select on a table. Where conditions number their params
+// from $1 like the other Database methods, they're renumbered as they're
+// combined. It's ran by All, First, Count or Paginate.
+type Query struct {
+	db        *Database
+	table     string
+	columns   string
+	wheres    []string
+	args      []interface{}
+	orderBy   []string
+	limit     int64
+	offset    int64
+	forUpdate bool
+}
+
+// Page describes the page Paginate or PaginateAfter loaded
+type Page struct {
+	Page  int64 `json:"page"`
+	Limit int64 `json:"limit"`
+	Total int64 `json:"total"`
+	// Next is the cursor of the next page for PaginateAfter, empty on the last one
+	Next string `json:"next,omitempty"`
+}
+
+// Pages is how many pages there are, at least one
+func (p *Page) Pages() int64 {
+	if p.Total <= p.Limit || p.Limit <= 0 {
+		return 1
+	}
+	return (p.Total + p.Limit - 1) / p.Limit
+}
+
+// HasPrev returns whether there's a page before this one (offset pagination)
+func (p *Page) HasPrev() bool {
+	return p.Page > 1
+}
+
+// HasNext returns whether there's a page after this one
+func (p *Page) HasNext() bool {
+	return p.Next != "" || (p.Page > 0 && p.Page < p.Pages())
+}
+
+var queryParamRegexp = regexp.MustCompile(`\$(\d+)`)
+
+// Query starts a query on the table of model (a struct or slice of them, or pointers to those)
+func (db *Database) Query(model interface{}) *Query {
+	return db.From(tableNameFor(model))
+}
+
+// From starts a query on a table, which can be aliased ("leaderboards_users u")
+func (db *Database) From(table string) *Query {
+	return &Query{db: db, table: table, columns: "*"}
+}
+
+// Select sets the columns selected, all of them by default
+func (q *Query) Select(columns string) *Query {
+	q.columns = columns
+	return q
+}
+
+// Where adds a condition, and-ed with the others
+func (q *Query) Where(condition string, args ...interface{}) *Query {
+	shift := len(q.args)
+	q.wheres = append(q.wheres, "("+queryParamRegexp.ReplaceAllStringFunc(condition, func(s string) string {
+		n, _ := strconv.Atoi(s[1:])
+		return "$" + strconv.Itoa(n+shift)
+	})+")")
+	q.args = append(q.args, args...)
+	return q
+}
+
+// OrderBy adds an ordering, like "points desc"
+func (q *Query) OrderBy(order string) *Query {
+	q.orderBy = append(q.orderBy, order)
+	return q
+}
+
+func (q *Query) Limit(limit int64) *Query {
+	q.limit = limit
+	return q
+}
+
+func (q *Query) Offset(offset int64) *Query {
+	q.offset = offset
+	return q
+}
+
+// ForUpdate locks the rows selected till the end of the transaction
+func (q *Query) ForUpdate() *Query {
+	q.forUpdate = true
+	return q
+}
+
+func (q *Query) where() string {
+	if len(q.wheres) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.wheres, " AND ")
+}
+
+// SQL returns the query and its params
+func (q *Query) SQL() (string, []interface{}) {
+	sql := "SELECT " + q.columns + " FROM " + q.table + q.where()
+	if len(q.orderBy) > 0 {
+		sql += " ORDER BY " + strings.Join(q.orderBy, ", ")
+	}
+	if q.limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", q.limit)
+	}
+	if q.offset > 0 {
+		sql += fmt.Sprintf(" OFFSET %d", q.offset)
+	}
+	if q.forUpdate {
+		sql += " FOR UPDATE"
+	}
+	return sql, q.args
+}
+
+// All loads the rows matching into result, a pointer to a slice of structs
+func (q *Query) All(result interface{}) {
+	Check(q.AllErr(result))
+}
+
+// AllErr loads the rows matching into result, a pointer to a slice of structs
+func (q *Query) AllErr(result interface{}) error {
+	sql, args := q.SQL()
+	return q.db.AllErr(result, sql, args...)
+}
+
+// First loads the first row matching into result, a pointer to a struct
+func (q *Query) First(result interface{}) {
+	Check(q.FirstErr(result))
+}
+
+// FirstErr loads the first row matching into result, returning ErrDatabaseNotFound if there's none
+func (q *Query) FirstErr(result interface{}) error {
+	limit := q.limit
+	q.limit = 1
+	sql, args := q.SQL()
+	q.limit = limit
+	return q.db.FirstErr(result, sql, args...)
+}
+
+// Count returns how many rows match, ignoring the order, limit and offset
+func (q *Query) Count() int64 {
+	n, err := q.CountErr()
+	Check(err)
+	return n
+}
+
+// CountErr returns how many rows match, ignoring the order, limit and offset
+func (q *Query) CountErr() (int64, error) {
+	count := struct{ Count int64 }{}
+	err := q.db.FirstErr(&count, "SELECT count(*) count FROM "+q.table+q.where(), q.args...)
+	return count.Count, err
+}
+
+// Paginate loads page (from 1) of limit rows into result along with the total count
+func (q *Query) Paginate(result interface{}, page, limit int64) *Page {
+	p, err := q.PaginateErr(result, page, limit)
+	Check(err)
+	return p
+}
+
+// PaginateErr loads page (from 1) of limit rows into result along with the total count
+func (q *Query) PaginateErr(result interface{}, page, limit int64) (*Page, error) {
+	if page < 1 {
+		page = 1
+	}
+	total, err := q.CountErr()
+	if err != nil {
+		return nil, err
+	}
+	q.limit, q.offset = limit, (page-1)*limit
+	if err := q.AllErr(result); err != nil {
+		return nil, err
+	}
+	return &Page{Page: page, Limit: limit, Total: total}, nil
+}
+
+// PaginateAfter loads the limit rows after the cursor into result, ordered by
+// column which must be unique (like id), or a comma separated list of columns
+// that are together (like "created, id"). Unlike offsets, pages don't shift
+// when rows are added while going through them. The cursor is empty for the
+// first page, then the Next of the previous one.
+func (q *Query) PaginateAfter(result interface{}, column string, desc bool, after string, limit int64) *Page {
+	p, err := q.PaginateAfterErr(result, column, desc, after, limit)
+	Check(err)
+	return p
+}
+
+// PaginateAfterErr loads the limit rows after the cursor into result, ordered by column(s)
+func (q *Query) PaginateAfterErr(result interface{}, column string, desc bool, after string, limit int64) (*Page, error) {
+	total, err := q.CountErr()
+	if err != nil {
+		return nil, err
+	}
+	columns := strings.Split(column, ",")
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+	op, direction := ">", " ASC"
+	if desc {
+		op, direction = "<", " DESC"
+	}
+	if after != "" {
+		// Only the last column can contain commas, the others are times or numbers
+		values := strings.SplitN(after, ",", len(columns))
+		if len(values) != len(columns) {
+			return nil, fmt.Errorf("Query: invalid cursor %q for %s", after, column)
+		}
+		params, args := []string{}, []interface{}{}
+		for i, v := range values {
+			params = append(params, "$"+strconv.Itoa(i+1))
+			args = append(args, v)
+		}
+		q.Where("("+strings.Join(columns, ", ")+") "+op+" ("+strings.Join(params, ", ")+")", args...)
+	}
+	q.orderBy = []string{}
+	for _, c := range columns {
+		q.orderBy = append(q.orderBy, c+direction)
+	}
+	q.limit, q.offset = limit+1, 0
+	if err := q.AllErr(result); err != nil {
+		return nil, err
+	}
+	// We loaded one more than asked to know if there's a next page
+	p := &Page{Limit: limit, Total: total}
+	rows := reflect.ValueOf(result).Elem()
+	if int64(rows.Len()) > limit {
+		rows.Set(rows.Slice(0, int(limit)))
+		values := []string{}
+		for _, c := range columns {
+			values = append(values, fmt.Sprint(columnValue(rows.Index(int(limit)-1), c)))
+		}
+		p.Next = strings.Join(values, ",")
+	}
+	return p, nil
+}
+
+// columnValue returns the value of the field of a struct mapped to column
+func columnValue(v reflect.Value, column string) interface{} {
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if i := strings.LastIndex(column, "."); i >= 0 {
+		column = column[i+1:]
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if name, ok := columnName(t.Field(i)); ok && name == column {
+			value := v.Field(i).Interface()
+			if t, ok := value.(time.Time); ok {
+				return t.Format(time.RFC3339Nano)
+			}
+			if s, ok := value.(fmt.Stringer); ok {
+				return s.String()
+			}
+			return value
+		}
+	}
+	panic(fmt.Errorf("Query: no field for column %s in %s", column, t))
+}
+
+// columnName returns the column of a struct field, from its `db` tag or its
+// snake cased name, and false for fields without one (tagged `db:"-"`)
+func columnName(field reflect.StructField) (string, bool) {
+	tag := strings.Split(field.Tag.Get("db"), ",")[0]
+	if tag == "-" {
+		return "", false
+	}
+	if tag != "" {
+		return tag, true
+	}
+	return StringToSnakeCase(field.Name), true
+}
@@ -1,16 +1,22 @@
 package lib
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 var jobs = map[string]func(*Ctx, J){}
+var jobOptions = map[string]JobOptions{}
 
 func RegisterJob(name string, handler func(*Ctx, J)) string {
 	if jobs[name] != nil {
@@ -20,102 +26,587 @@ func RegisterJob(name string, handler func(*Ctx, J)) string {
 	return name
 }
 
+// JobOptions tunes where and how a job runs, and how it's retried when it fails
+type JobOptions struct {
+	// Queue is the named queue the job goes in, processes only run the queues in JOB_QUEUES
+	Queue string
+	// Priority is used when enqueuing the job without one
+	Priority int64
+	// Concurrency is how many runs of the job there can be at once across all workers, 0 for no limit
+	Concurrency int64
+	// Timeout cancels the job's context (c.Context()) when it runs longer, 0 for no limit
+	Timeout time.Duration
+	// MaxAttempts is how many times the job runs before going to app_jobs_dead
+	MaxAttempts int64
+	// Backoff is the delay before the first retry, doubling with every attempt
+	Backoff time.Duration
+}
+
+const JobQueueDefault = "default"
+
+var defaultJobOptions = JobOptions{Queue: JobQueueDefault, Priority: JobPriorityLow, MaxAttempts: 3, Backoff: 10 * time.Second}
+
+// RegisterJobOptions sets the options of a job, unset ones take the defaults:
+// the default queue, low priority, no concurrency or time limit, 3 attempts
+// and a 10s backoff
+func RegisterJobOptions(name string, options JobOptions) string {
+	if _, ok := jobOptions[name]; ok {
+		panic(errors.New("RegisterJobOptions: Options already set for: " + name))
+	}
+	if options.Queue == "" {
+		options.Queue = defaultJobOptions.Queue
+	}
+	if options.Priority == 0 {
+		options.Priority = defaultJobOptions.Priority
+	}
+	if options.MaxAttempts < 1 {
+		options.MaxAttempts = defaultJobOptions.MaxAttempts
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = defaultJobOptions.Backoff
+	}
+	jobOptions[name] = options
+	return name
+}
+
+// jobConcurrencyLimits lists the jobs with a concurrency limit and their limits
+func jobConcurrencyLimits() ([]string, []int64) {
+	names, limits := []string{}, []int64{}
+	for name, options := range jobOptions {
+		if options.Concurrency > 0 {
+			names = append(names, name)
+			limits = append(limits, options.Concurrency)
+		}
+	}
+	return names, limits
+}
+
+func jobOptionsFor(name string) JobOptions {
+	if options, ok := jobOptions[name]; ok {
+		return options
+	}
+	return defaultJobOptions
+}
+
 const (
 	JobPriorityHigh   int64 = 1
 	JobPriorityMedium int64 = 2
 	JobPriorityLow    int64 = 3
 )
 
+// jobLease is how long a worker holds a job for, it's extended while the job
+// runs so it only runs out when the worker died
+const jobLease = time.Minute
+
 type Job struct {
+	ID          string
+	Name        string
+	Args        J
+	Priority    int64
+	Created     time.Time
+	RunAt       time.Time
+	Queue       string
+	UniqueKey   string
+	Attempts    int64
+	LockedUntil *time.Time
+	LockedBy    string
+	LastError   string
+}
+
+// JobDead is a job that failed all its attempts
+type JobDead struct {
 	ID       string
 	Name     string
 	Args     J
 	Priority int64
 	Created  time.Time
+	Attempts int64
+	Error    string
+	Stack    string
+	Failed   time.Time
 }
 
+const (
+	JobRunRunning     = "running"
+	JobRunSuccess     = "success"
+	JobRunFailed      = "failed"
+	JobRunInterrupted = "interrupted"
+)
+
+// JobRun records one execution of a job, Duration is in milliseconds
+type JobRun struct {
+	ID       string
+	JobID    string
+	Name     string
+	Args     J
+	Queue    string
+	Attempt  int64
+	Node     string
+	Status   string
+	Error    string
+	Started  time.Time
+	Duration int64
+}
+
+// jobError is a job's panic, with the stack it happened at
+type jobError struct {
+	err   string
+	stack string
+}
+
+func (e *jobError) Error() string {
+	return e.err
+}
+
+var errJobInterrupted = errors.New("job interrupted")
+
 type JobQueue struct {
 	ctx    *Ctx
 	db     *Database
 	server *Server
-	stop   bool
 	wg     sync.WaitGroup
+	worker string
+	// Workers is how many jobs run at once, Queues the queues they take jobs
+	// from (all when empty). From JOB_WORKERS (default 4) and JOB_QUEUES.
+	Workers int
+	Queues  []string
+
+	// stopping is closed to stop taking jobs, jobsCtx is cancelled when running
+	// jobs didn't finish in time. Jobs taken but not finished are kept in
+	// running to release them for other workers.
+	stopping   chan struct{}
+	stopOnce   sync.Once
+	jobsCtx    context.Context
+	cancelJobs context.CancelFunc
+	mu         sync.Mutex
+	running    map[string]*Job
 }
 
 func (q *JobQueue) WithCtx(ctx *Ctx) *JobQueue {
-	return &JobQueue{db: q.db.WithCtx(ctx), server: q.server, ctx: ctx}
+	return &JobQueue{db: q.db.WithCtx(ctx), server: q.server, ctx: ctx, worker: q.worker}
 }
 
 func NewJobQueue(s *Server) *JobQueue {
-	return &JobQueue{db: s.Database, server: s}
+	jobsCtx, cancelJobs := context.WithCancel(context.Background())
+	hostname, _ := os.Hostname()
+	workers := int(StringToInt(Env("JOB_WORKERS", "4")))
+	if workers < 1 {
+		workers = 1
+	}
+	queues := []string{}
+	for _, name := range strings.Split(Env("JOB_QUEUES", ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			queues = append(queues, name)
+		}
+	}
+	return &JobQueue{db: s.Database, server: s, worker: fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), NewID()[:8]),
+		Workers: workers, Queues: queues,
+		stopping: make(chan struct{}), jobsCtx: jobsCtx, cancelJobs: cancelJobs, running: map[string]*Job{}}
 }
 
 func (q *JobQueue) Start() {
-	q.wg.Add(1)
-	go q.start()
+	Log("info", "job queue starting", J{"workers": q.Workers, "queues": q.Queues})
+	for i := 0; i < q.Workers; i++ {
+		q.wg.Add(1)
+		go q.start()
+	}
 }
 
 func (q *JobQueue) start() {
 	defer q.wg.Done()
-	for !q.stop {
-		jobs := []*Job{}
-		q.db.All(&jobs, `delete from app_jobs where id in (select id from app_jobs where created < $1 order by priority, created asc limit 5) returning *`, time.Now())
-		for _, job := range jobs {
-			q.RunJob(job.Name, job.Args)
+	for {
+		select {
+		case <-q.stopping:
+			return
+		default:
 		}
-		// Sleep if we had nothing to do, else, run the next batch as fast as possible
-		if len(jobs) == 0 {
-			time.Sleep(time.Second)
+		job, err := q.lease()
+		if err != nil {
+			Log("error", "JobQueue: leasing job", J{"error": err.Error()})
 		}
+		if job == nil {
+			// Sleep if we had nothing to do, else, run the next job as fast as possible
+			select {
+			case <-q.stopping:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		q.mu.Lock()
+		q.running[job.ID] = job
+		q.mu.Unlock()
+		q.finish(job, q.runLeased(job))
 	}
 }
 
-func (q *JobQueue) Stop() {
-	q.stop = true
-	q.wg.Wait()
+// lease takes the next job that's due in our queues, isn't held by a live
+// worker (others skip the row we lock) and whose name isn't at its concurrency
+// limit. Counting running jobs is only safe one worker at a time, so when
+// there are limits leasing is serialized with an advisory lock.
+func (q *JobQueue) lease() (*Job, error) {
+	names, limits := jobConcurrencyLimits()
+	jobs := []*Job{}
+	err := q.db.Tx(func(tx *Database) error {
+		if len(names) > 0 {
+			if err := tx.ExecuteErr(`select pg_advisory_xact_lock(hashtext('app_jobs'))`); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		return tx.AllErr(&jobs, `update app_jobs set locked_until = $2, locked_by = $3, attempts = attempts + 1 where id in (
+  select j.id from app_jobs j
+  where j.run_at <= $1 and (j.locked_until is null or j.locked_until < $1)
+    and (cardinality($4::text[]) = 0 or j.queue = any($4))
+    and j.name not in (
+      select r.name from app_jobs r join unnest($5::text[], $6::bigint[]) l(name, max) on l.name = r.name
+      where r.locked_until >= $1 group by r.name, l.max having count(*) >= l.max)
+  order by j.priority, j.run_at asc limit 1 for update of j skip locked) returning *`,
+			now, now.Add(jobLease), q.worker, pq.Array(q.Queues), pq.Array(names), pq.Array(limits))
+	})
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return jobs[0], nil
+}
+
+// runLeased runs a job with its timeout, extending its lease till it returns
+func (q *JobQueue) runLeased(job *Job) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(jobLease / 3):
+				err := q.db.ExecuteErr(`update app_jobs set locked_until = $3 where id = $1 and locked_by = $2`,
+					job.ID, q.worker, time.Now().Add(jobLease))
+				if err != nil {
+					Log("error", "JobQueue: extending lease", J{"id": job.ID, "name": job.Name, "error": err.Error()})
+				}
+			}
+		}
+	}()
+	ctx := q.jobsCtx
+	if timeout := jobOptionsFor(job.Name).Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return q.runRecorded(ctx, job)
+}
+
+// runRecorded runs a job, recording the run in app_job_runs. Failing to
+// record it is logged but doesn't stop the job.
+func (q *JobQueue) runRecorded(ctx context.Context, job *Job) error {
+	queue := job.Queue
+	if queue == "" {
+		queue = jobOptionsFor(job.Name).Queue
+	}
+	run := &JobRun{ID: NewID(), JobID: job.ID, Name: job.Name, Args: job.Args, Queue: queue, Attempt: job.Attempts,
+		Node: q.worker, Status: JobRunRunning, Started: time.Now()}
+	err := q.db.ExecuteErr(`insert into app_job_runs (id, job_id, name, args, queue, attempt, node, status, error, started, duration) values ($1, $2, $3, $4, $5, $6, $7, $8, '', $9, 0)`,
+		run.ID, run.JobID, run.Name, run.Args, run.Queue, run.Attempt, run.Node, run.Status, run.Started)
+	if err != nil {
+		Log("error", "JobQueue: recording run", J{"name": job.Name, "error": err.Error()})
+	}
+
+	jobErr := q.run(ctx, job.Name, job.Args)
+	run.Status = JobRunSuccess
+	if errors.Is(jobErr, errJobInterrupted) {
+		run.Status = JobRunInterrupted
+	} else if jobErr != nil {
+		run.Status = JobRunFailed
+		run.Error = jobErr.Error()
+	}
+	run.Duration = time.Since(run.Started).Milliseconds()
+	err = q.db.ExecuteErr(`update app_job_runs set status = $2, error = $3, duration = $4 where id = $1`,
+		run.ID, run.Status, run.Error, run.Duration)
+	if err != nil {
+		Log("error", "JobQueue: recording run", J{"name": job.Name, "error": err.Error()})
+	}
+	return jobErr
+}
+
+// finish forgets a running job (unless Stop already released it) and records
+// how it went: deleted when it succeeded, released when interrupted, retried
+// later or moved to app_jobs_dead when it failed
+func (q *JobQueue) finish(job *Job, err error) {
+	q.mu.Lock()
+	_, ok := q.running[job.ID]
+	delete(q.running, job.ID)
+	q.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err == nil {
+		q.db.Execute(`delete from app_jobs where id = $1 and locked_by = $2`, job.ID, q.worker)
+		return
+	}
+	if errors.Is(err, errJobInterrupted) {
+		q.release(job)
+		return
+	}
+	stack := ""
+	if jerr, ok := err.(*jobError); ok {
+		stack = jerr.stack
+	}
+	options := jobOptionsFor(job.Name)
+	if job.Attempts >= options.MaxAttempts {
+		Log("error", "JobQueue: job failed all attempts", J{"id": job.ID, "name": job.Name, "attempts": job.Attempts, "error": err.Error()})
+		q.db.Execute(`insert into app_jobs_dead (id, name, args, priority, created, attempts, error, stack, failed) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+on conflict (id) do update set attempts = $6, error = $7, stack = $8, failed = $9`,
+			job.ID, job.Name, job.Args, job.Priority, job.Created, job.Attempts, err.Error(), stack, time.Now())
+		q.db.Execute(`delete from app_jobs where id = $1 and locked_by = $2`, job.ID, q.worker)
+		return
+	}
+	backoff := time.Duration(float64(options.Backoff) * math.Pow(2, float64(job.Attempts-1)))
+	if backoff > time.Hour {
+		backoff = time.Hour
+	}
+	q.db.Execute(`update app_jobs set run_at = $3, locked_until = null, locked_by = '', last_error = $4 where id = $1 and locked_by = $2`,
+		job.ID, q.worker, time.Now().Add(backoff), err.Error())
+}
+
+// release gives a job back to the queue without counting its attempt
+func (q *JobQueue) release(job *Job) {
+	Log("info", "JobQueue: releasing unfinished job", J{"id": job.ID, "name": job.Name})
+	q.db.Execute(`update app_jobs set locked_until = null, locked_by = '', attempts = greatest(attempts - 1, 0) where id = $1 and locked_by = $2`,
+		job.ID, q.worker)
+}
+
+// Stop stops taking new jobs and waits for the running ones till ctx is done.
+// Jobs still running then have their context cancelled and, if they don't
+// return shortly after, are released to be ran again.
+func (q *JobQueue) Stop(ctx context.Context) {
+	q.stopOnce.Do(func() { close(q.stopping) })
+	if waitGroupDone(ctx, &q.wg) {
+		return
+	}
+	q.cancelJobs()
+	graceCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if waitGroupDone(graceCtx, &q.wg) {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, job := range q.running {
+		delete(q.running, id)
+		q.release(job)
+	}
+}
+
+// waitGroupDone waits for wg till ctx is done, returning whether wg finished
+func waitGroupDone(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// EnqueueOpts are the options of an enqueued job. Jobs with a UniqueKey
+// aren't enqueued while one with the same key is pending or running, and
+// with UniqueFor either till that long after the first was enqueued.
+type EnqueueOpts struct {
+	// Priority overrides the job's default priority
+	Priority int64
+	// RunAt delays the job till then, it runs as soon as possible when zero
+	RunAt     time.Time
+	UniqueKey string
+	UniqueFor time.Duration
+}
+
+// JobRequest is a job to enqueue with EnqueueMany
+type JobRequest struct {
+	Name string
+	Args J
+	EnqueueOpts
 }
 
 func (q *JobQueue) Enqueue(name string, args J, priorityArgs ...int64) {
-	// TODO batch inserts
-	priority := JobPriorityLow
+	opts := EnqueueOpts{}
 	if len(priorityArgs) > 0 {
-		priority = priorityArgs[0]
+		opts.Priority = priorityArgs[0]
 	}
-	q.db.Execute(`insert into app_jobs (id, name, args, priority, created) values ($1, $2, $3, $4, $5)`,
-		NewID(), name, args, priority, time.Now())
+	q.EnqueueWith(name, args, opts)
 }
 
 func (q *JobQueue) Delay(name string, args J, delay time.Duration, priorityArgs ...int64) {
-	// TODO batch inserts
-	priority := JobPriorityLow
+	opts := EnqueueOpts{RunAt: time.Now().Add(delay)}
 	if len(priorityArgs) > 0 {
-		priority = priorityArgs[0]
+		opts.Priority = priorityArgs[0]
 	}
-	q.db.Execute(`insert into app_jobs (id, name, args, priority, created) values ($1, $2, $3, $4, $5)`,
-		NewID(), name, args, priority, time.Now().Add(delay))
+	q.EnqueueWith(name, args, opts)
+}
+
+// EnqueueWith enqueues a job with options, returning false if it was a duplicate
+func (q *JobQueue) EnqueueWith(name string, args J, opts EnqueueOpts) bool {
+	return q.EnqueueMany([]*JobRequest{{Name: name, Args: args, EnqueueOpts: opts}}) == 1
+}
+
+// EnqueueMany enqueues jobs in one insert, returning how many weren't duplicates
+func (q *JobQueue) EnqueueMany(requests []*JobRequest) int64 {
+	n, err := q.EnqueueManyErr(requests)
+	Check(err)
+	return n
+}
+
+// EnqueueManyErr enqueues jobs in one insert, returning how many weren't duplicates
+func (q *JobQueue) EnqueueManyErr(requests []*JobRequest) (int64, error) {
+	if len(requests) == 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	// Claim the keys unique for a while first, those still claimed by an earlier job are skipped
+	keys, expires := []string{}, []time.Time{}
+	seen := map[string]bool{}
+	for _, r := range requests {
+		if r.UniqueKey != "" && r.UniqueFor > 0 && !seen[r.UniqueKey] {
+			seen[r.UniqueKey] = true
+			keys = append(keys, r.UniqueKey)
+			expires = append(expires, now.Add(r.UniqueFor))
+		}
+	}
+	claimed := map[string]bool{}
+	if len(keys) > 0 {
+		rows := []string{}
+		err := q.db.AllErr(&rows, `insert into app_job_keys (key, expires) select * from unnest($1::text[], $2::timestamptz[])
+on conflict (key) do update set expires = excluded.expires where app_job_keys.expires < now() returning key`, pq.Array(keys), pq.Array(expires))
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range rows {
+			claimed[key] = true
+		}
+	}
+
+	ids, names, args, priorities, runAts, queues, uniqueKeys := []string{}, []string{}, []string{}, []int64{}, []time.Time{}, []string{}, []string{}
+	for _, r := range requests {
+		if r.UniqueKey != "" && r.UniqueFor > 0 && !claimed[r.UniqueKey] {
+			continue
+		}
+		// Only the first of a key claimed by this batch goes in
+		delete(claimed, r.UniqueKey)
+		options := jobOptionsFor(r.Name)
+		priority := options.Priority
+		if r.Priority != 0 {
+			priority = r.Priority
+		}
+		runAt := r.RunAt
+		if runAt.IsZero() {
+			runAt = now
+		}
+		encoded, err := json.Marshal(r.Args)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, NewID())
+		names = append(names, r.Name)
+		args = append(args, string(encoded))
+		priorities = append(priorities, priority)
+		runAts = append(runAts, runAt)
+		queues = append(queues, options.Queue)
+		uniqueKeys = append(uniqueKeys, r.UniqueKey)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	inserted := []string{}
+	err := q.db.AllErr(&inserted, `insert into app_jobs (id, name, args, priority, created, run_at, queue, unique_key)
+select id, name, args, priority, $8, run_at, queue, unique_key
+from unnest($1::text[], $2::text[], $3::jsonb[], $4::int[], $5::timestamptz[], $6::text[], $7::text[]) t(id, name, args, priority, run_at, queue, unique_key)
+on conflict do nothing returning id`,
+		pq.Array(ids), pq.Array(names), pq.Array(args), pq.Array(priorities), pq.Array(runAts), pq.Array(queues), pq.Array(uniqueKeys), now)
+	return int64(len(inserted)), err
+}
+
+// RequeueDead moves dead jobs back to the queue with their attempts reset, all
+// of them or only the one with the given id or name
+func (q *JobQueue) RequeueDead(idOrName string) int64 {
+	requeued := []*JobDead{}
+	q.db.All(&requeued, `delete from app_jobs_dead where $1 = '' or id = $1 or name = $1 returning *`, idOrName)
+	for _, job := range requeued {
+		q.db.Execute(`insert into app_jobs (id, name, args, priority, created, run_at, queue) values ($1, $2, $3, $4, $5, $6, $7) on conflict (id) do nothing`,
+			job.ID, job.Name, job.Args, job.Priority, job.Created, time.Now(), jobOptionsFor(job.Name).Queue)
+	}
+	return int64(len(requeued))
 }
 
 func (q *JobQueue) RunJob(name string, args J) {
+	if err := q.run(context.Background(), name, args); err != nil {
+		Log("error", "JobQueue: RunJob: failed", J{"name": name, "error": err.Error()})
+	}
+}
+
+// run runs a job with ctx as its context, returning its panic, or when it
+// panicked because its context was done, errJobInterrupted if the queue
+// cancelled it while stopping and an error if it timed out. A job that returns
+// is a success however late it is.
+func (q *JobQueue) run(ctx context.Context, name string, args J) (err error) {
 	handler, ok := jobs[name]
 	if !ok {
 		Log("error", "RunJob: No job for given name", J{"name": name})
-		return
+		return errors.New("RunJob: No job for given name: " + name)
 	}
-	c := q.ctx
-	if c == nil {
+	var c *Ctx
+	if q.ctx == nil {
 		c = NewCtx(q.server)
+		c.ctx = ctx
+	} else {
+		// Run with the Ctx the queue was bound to, cancelled when either its
+		// context or the caller's is
+		parent := q.ctx.Context()
+		jobCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-parent.Done():
+				cancel()
+			case <-jobCtx.Done():
+			}
+		}()
+		bound := *q.ctx
+		bound.ctx = jobCtx
+		bound.Data = J{}
+		for k, v := range q.ctx.Data {
+			bound.Data[k] = v
+		}
+		c = &bound
 	}
 	defer func() {
-		if err := recover(); err != nil {
-			Log("error", "JobQueue: RunJob: panic", J{
-				"name":  name,
-				"args":  args,
-				"error": fmt.Sprintf("%v", err),
-				"stack": string(debug.Stack()),
-			})
+		r := recover()
+		if r == nil {
+			// It finished, even if past its deadline or while stopping
+			return
+		}
+		// A job failing once its context is done failed because of it
+		if q.jobsCtx != nil && q.jobsCtx.Err() != nil {
+			err = errJobInterrupted
+			return
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("job timed out after %s", jobOptionsFor(name).Timeout)
+			return
 		}
+		stack := string(debug.Stack())
+		Log("error", "JobQueue: RunJob: panic", J{
+			"name":  name,
+			"args":  args,
+			"error": fmt.Sprintf("%v", r),
+			"stack": stack,
+		})
+		err = &jobError{err: fmt.Sprintf("%v", r), stack: stack}
 	}()
 	handler(c, args)
+	return nil
 }
 
 func (q *JobQueue) RunCliJob() {
@@ -0,0 +1,206 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket budget: Burst requests at once, refilled at Rate per second
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// PerMinute is a budget of n requests a minute, all of which can be used at once
+func PerMinute(n float64) RateLimit {
+	return RateLimit{Rate: n / 60, Burst: n}
+}
+
+type rateRoute struct {
+	prefix string
+	limit  RateLimit
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits requests per client IP and per address cookie, with
+// budgets per route. Buckets are kept in process, each instance limits the
+// requests it serves.
+type RateLimiter struct {
+	Default RateLimit
+	// TrustProxy reads the client IP from X-Forwarded-For, for when behind a load
+	// balancer. It's the rightmost IP that isn't one of TrustedProxies, as the
+	// ones left of it are set by the client.
+	TrustProxy     bool
+	TrustedProxies []*net.IPNet
+
+	routes  []rateRoute
+	allowed []*net.IPNet
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+// NewRateLimiter creates a limiter with a default budget for routes without one.
+// It reads RATE_LIMIT_TRUST_PROXY ("1" when behind a load balancer),
+// RATE_LIMIT_TRUSTED_PROXIES (comma separated IPs or CIDRs of our proxies in
+// front of the load balancer, if any) and RATE_LIMIT_ALLOW (comma separated
+// IPs or CIDRs never limited, like our monitoring).
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	l := &RateLimiter{Default: limit, TrustProxy: EnvBool("RATE_LIMIT_TRUST_PROXY"), buckets: map[string]*rateBucket{}}
+	for _, a := range strings.Split(Env("RATE_LIMIT_TRUSTED_PROXIES", ""), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			l.TrustedProxies = append(l.TrustedProxies, parseIPNet(a))
+		}
+	}
+	for _, a := range strings.Split(Env("RATE_LIMIT_ALLOW", ""), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			l.Allow(a)
+		}
+	}
+	go l.prune()
+	return l
+}
+
+// Route sets the budget for paths starting with prefix, the longest prefix wins
+func (l *RateLimiter) Route(prefix string, limit RateLimit) {
+	l.routes = append(l.routes, rateRoute{prefix: prefix, limit: limit})
+}
+
+// Allow exempts an IP or CIDR range from limits
+func (l *RateLimiter) Allow(ipOrCIDR string) {
+	l.allowed = append(l.allowed, parseIPNet(ipOrCIDR))
+}
+
+func parseIPNet(ipOrCIDR string) *net.IPNet {
+	if !strings.Contains(ipOrCIDR, "/") {
+		if strings.Contains(ipOrCIDR, ":") {
+			ipOrCIDR += "/128"
+		} else {
+			ipOrCIDR += "/32"
+		}
+	}
+	_, network, err := net.ParseCIDR(ipOrCIDR)
+	if err != nil {
+		panic(fmt.Errorf("RateLimiter: invalid ip: %w", err))
+	}
+	return network
+}
+
+// Middleware answers 429 with a Retry-After once the client's IP, or the address
+// it's connected with, is over the route's budget
+func (l *RateLimiter) Middleware(c *Ctx) {
+	ip := l.clientIP(c.Req)
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, network := range l.allowed {
+			if network.Contains(parsed) {
+				return
+			}
+		}
+	}
+	prefix, limit := l.route(c.Req.URL.Path)
+	keys := []string{prefix + "|ip|" + ip}
+	if address := c.GetCookie("address"); address != "" {
+		keys = append(keys, prefix+"|address|"+strings.ToLower(address))
+	}
+	if wait := l.take(keys, limit); wait > 0 {
+		Log("warning", "rate limited", J{"ip": ip, "path": c.Req.URL.Path, "route": prefix})
+		c.Res.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+		c.JSON(429, J{"error": "too many requests"})
+	}
+}
+
+func (l *RateLimiter) route(path string) (string, RateLimit) {
+	prefix, limit := "", l.Default
+	for _, r := range l.routes {
+		if strings.HasPrefix(path, r.prefix) && len(r.prefix) > len(prefix) {
+			prefix, limit = r.prefix, r.limit
+		}
+	}
+	return prefix, limit
+}
+
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !l.TrustProxy {
+		return host
+	}
+	// Each proxy appends who it got the request from, walk back from the last
+	// to the first one added by a machine that isn't ours
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		if !l.trusted(ip) {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+func (l *RateLimiter) trusted(ip net.IP) bool {
+	for _, network := range l.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// take uses a token from each bucket, or none if one of them is empty in which
+// case it returns how long until it has one again
+func (l *RateLimiter) take(keys []string, limit RateLimit) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	buckets := []*rateBucket{}
+	wait := time.Duration(0)
+	for _, key := range keys {
+		b := l.buckets[key]
+		if b == nil {
+			b = &rateBucket{tokens: limit.Burst, last: now}
+			l.buckets[key] = b
+		}
+		b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+		b.last = now
+		if b.tokens < 1 {
+			if w := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0
+}
+
+// prune forgets buckets that have been idle long enough to be full again
+func (l *RateLimiter) prune() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			_, limit := l.route(strings.SplitN(key, "|", 2)[0])
+			if time.Since(b.last).Seconds()*limit.Rate >= limit.Burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
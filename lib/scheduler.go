@@ -1,18 +1,73 @@
 package lib
 
 import (
+	"context"
 	"errors"
+	"math/rand"
 	"sync"
 	"time"
 )
 
-var globalSchedules = map[string]time.Duration{}
+const (
+	// ScheduleCatchUpOnce runs a job once after downtime however many runs were missed
+	ScheduleCatchUpOnce = "once"
+	// ScheduleCatchUpSkip skips missed runs, the job runs at its next time
+	ScheduleCatchUpSkip = "skip"
+	// ScheduleCatchUpAll runs a job for every run missed (up to 100), with the time of the run as the `slot` arg
+	ScheduleCatchUpAll = "all"
+)
+
+// scheduleGrace is how late a run can be before it's considered missed
+const scheduleGrace = 2 * time.Minute
+
+// ScheduleOptions tunes when a scheduled job is enqueued
+type ScheduleOptions struct {
+	// Jitter delays each run by a random duration up to it
+	Jitter time.Duration
+	// CatchUp is what to do with runs missed while no scheduler was running, ScheduleCatchUpOnce by default
+	CatchUp string
+}
+
+type scheduleEntry struct {
+	spec    string
+	next    func(time.Time) time.Time
+	options ScheduleOptions
+}
+
+var globalSchedules = map[string]*scheduleEntry{}
+
+// RegisterSchedule runs a job every runEvery, aligned on multiples of it (every hour runs on the hour)
+func RegisterSchedule(jobName string, runEvery time.Duration, options ...ScheduleOptions) string {
+	return registerSchedule(jobName, &scheduleEntry{
+		spec: "@every " + runEvery.String(),
+		next: func(t time.Time) time.Time { return t.Truncate(runEvery).Add(runEvery) },
+	}, options)
+}
+
+// RegisterCron runs a job on a cron expression (see cronSchedule), like
+// "0 0 * * mon" for every Monday at 00:00 UTC
+func RegisterCron(jobName string, spec string, options ...ScheduleOptions) string {
+	cron, err := parseCron(spec)
+	if err != nil {
+		panic(errors.New("RegisterCron: " + jobName + ": " + err.Error()))
+	}
+	if cron.Next(time.Now()).IsZero() {
+		panic(errors.New("RegisterCron: " + jobName + ": " + spec + " never runs"))
+	}
+	return registerSchedule(jobName, &scheduleEntry{spec: spec, next: cron.Next}, options)
+}
 
-func RegisterSchedule(jobName string, runEvery time.Duration) string {
-	if globalSchedules[jobName] != 0 {
+func registerSchedule(jobName string, entry *scheduleEntry, options []ScheduleOptions) string {
+	if globalSchedules[jobName] != nil {
 		panic(errors.New("RegisterSchedule: " + jobName + " already registered"))
 	}
-	globalSchedules[jobName] = runEvery
+	if len(options) > 0 {
+		entry.options = options[0]
+	}
+	if entry.options.CatchUp == "" {
+		entry.options.CatchUp = ScheduleCatchUpOnce
+	}
+	globalSchedules[jobName] = entry
 	return jobName
 }
 
@@ -20,17 +75,20 @@ type Schedule struct {
 	ID      string
 	LastRan time.Time
 	NextRun time.Time
+	Spec    string
 }
 
 type Scheduler struct {
-	db    *Database
-	queue *JobQueue
-	stop  bool
-	wg    sync.WaitGroup
+	db       *Database
+	lock     *Lock
+	queue    *JobQueue
+	wg       sync.WaitGroup
+	stopping chan struct{}
+	stopOnce sync.Once
 }
 
 func NewScheduler(s *Server) *Scheduler {
-	return &Scheduler{db: s.Database, queue: s.Queue}
+	return &Scheduler{db: s.Database, queue: s.Queue, lock: NewLock(s.Database, "scheduler", LockTTL), stopping: make(chan struct{})}
 }
 
 func (s *Scheduler) Start() {
@@ -44,41 +102,130 @@ func (s *Scheduler) start() {
 	schedules := []*Schedule{}
 	schedulesExisting := map[string]*Schedule{}
 	s.db.All(&schedules, "select * from app_schedules")
-	// Delete old schedules
+	now := time.Now()
 	for _, v := range schedules {
-		if globalSchedules[v.ID] == 0 {
+		entry := globalSchedules[v.ID]
+		// Delete old schedules
+		if entry == nil {
 			s.db.Execute(`delete from app_schedules where id = $1`, v.ID)
 			continue
 		}
 		schedulesExisting[v.ID] = v
+		// Rows from before specs were recorded keep their next run, only the spec is filled in
+		if v.Spec == "" {
+			s.db.Execute(`update app_schedules set spec = $2 where id = $1`, v.ID, entry.spec)
+			continue
+		}
+		// Pick up changed schedules, next running at the new one's next time
+		if v.Spec != entry.spec {
+			Log("info", "schedule changed", J{"id": v.ID, "from": v.Spec, "to": entry.spec})
+			s.db.Execute(`update app_schedules set spec = $2, next_run = $3 where id = $1`, v.ID, entry.spec, entry.next(now))
+		}
 	}
 	// Create new schedules
-	for id, interval := range globalSchedules {
+	for id, entry := range globalSchedules {
 		if schedulesExisting[id] != nil {
 			continue
 		}
-		s.db.Execute(`insert into app_schedules (id, last_ran, next_run) values ($1, $2, $3)`,
-			id, time.Now(), time.Now().Add(interval).Round(interval))
+		s.db.Execute(`insert into app_schedules (id, last_ran, next_run, spec) values ($1, $2, $3, $4) on conflict (id) do nothing`,
+			id, now, entry.next(now), entry.spec)
+	}
+
+	for {
+		if s.leader() {
+			s.tick()
+		}
+		// Wake up at the start of the next minute, cron's resolution
+		select {
+		case <-s.stopping:
+			return
+		case <-time.After(time.Until(time.Now().Truncate(time.Minute).Add(time.Minute + time.Second))):
+		}
+	}
+}
+
+// leader returns whether this node holds the scheduler lock, trying to get it
+// if not. Only the leader enqueues scheduled jobs, the next_run update guards
+// against two nodes thinking they are for a moment.
+func (s *Scheduler) leader() bool {
+	if s.lock.Token() != 0 {
+		return true
 	}
+	ok, err := s.lock.TryLock(context.Background())
+	if err != nil {
+		Log("error", "Scheduler: taking lock", J{"error": err.Error()})
+	} else if ok {
+		Log("info", "Scheduler: leading", J{"token": s.lock.Token()})
+	}
+	return ok
+}
 
-	for !s.stop {
-		schedules := []*Schedule{}
-		s.db.All(&schedules, "select * from app_schedules where next_run < $1", time.Now())
-		for _, v := range schedules {
-			// Try and update schedule next run first
-			interval := globalSchedules[v.ID]
-			schedulesUpdated := []*Schedule{}
-			s.db.All(&schedulesUpdated, `update app_schedules set last_ran = $3, next_run = $4 where id = $1 and next_run < $2 returning *`, v.ID, time.Now(), time.Now(), time.Now().Add(interval).Round(interval))
-			// We were the node to bump the next_run, execute job
-			if len(schedulesUpdated) > 0 {
-				s.queue.Enqueue(v.ID, J{}, JobPriorityHigh)
+func (s *Scheduler) tick() {
+	schedules := []*Schedule{}
+	now := time.Now()
+	s.db.All(&schedules, "select * from app_schedules where next_run <= $1", now)
+	for _, v := range schedules {
+		entry := globalSchedules[v.ID]
+		if entry == nil {
+			continue
+		}
+		// Runs due since next_run, the last of which isn't missed if it's recent
+		slots := []time.Time{}
+		next := v.NextRun
+		for !next.After(now) && len(slots) < 100 {
+			slots = append(slots, next)
+			next = entry.next(next)
+		}
+		for !next.After(now) {
+			next = entry.next(next)
+		}
+		// Try and update schedule next run first
+		schedulesUpdated := []*Schedule{}
+		s.db.All(&schedulesUpdated, `update app_schedules set last_ran = $3, next_run = $4 where id = $1 and next_run = $2 returning *`,
+			v.ID, v.NextRun, now, next)
+		// We were the node to bump the next_run, execute job
+		if len(schedulesUpdated) == 0 {
+			continue
+		}
+		last := slots[len(slots)-1]
+		recent := now.Sub(last) <= scheduleGrace
+		switch {
+		case len(slots) == 1 && recent:
+			s.enqueue(v.ID, entry, last, J{})
+		case entry.options.CatchUp == ScheduleCatchUpSkip:
+			if recent {
+				s.enqueue(v.ID, entry, last, J{})
 			}
+			Log("info", "schedule skipped missed runs", J{"id": v.ID, "slots": len(slots), "since": v.NextRun})
+		case entry.options.CatchUp == ScheduleCatchUpAll:
+			for _, slot := range slots {
+				s.enqueue(v.ID, entry, slot, J{"slot": slot.Format(time.RFC3339)})
+			}
+		default:
+			s.enqueue(v.ID, entry, last, J{})
 		}
-		time.Sleep(time.Minute)
 	}
 }
 
+// enqueue enqueues the run of a job for a slot, once even if two nodes get to it
+func (s *Scheduler) enqueue(name string, entry *scheduleEntry, slot time.Time, args J) {
+	delay := time.Duration(0)
+	if entry.options.Jitter > 0 {
+		delay = time.Duration(rand.Int63n(int64(entry.options.Jitter)))
+	}
+	s.queue.EnqueueWith(name, args, EnqueueOpts{
+		Priority:  JobPriorityHigh,
+		RunAt:     time.Now().Add(delay),
+		UniqueKey: "schedule:" + name + ":" + slot.UTC().Format(time.RFC3339),
+		UniqueFor: 24 * time.Hour,
+	})
+}
+
+// Stop stops scheduling jobs, waiting for the current check to finish
 func (s *Scheduler) Stop() {
-	s.stop = true
+	s.stopOnce.Do(func() { close(s.stopping) })
 	s.wg.Wait()
+	if s.lock.Token() != 0 {
+		s.lock.Unlock()
+	}
 }
@@ -20,6 +20,7 @@ import (
 )
 
 var templateFunctions = template.FuncMap{
+	"url":       URL,
 	"title":     strings.Title,
 	"snakeCase": StringToSnakeCase,
 	"slug":      StringToSlug,
@@ -10,7 +10,12 @@ import (
 	"github.com/joho/godotenv"
 )
 
+// Only the artifacts of contracts bound with lib.RegisterContractMethod are
+// embedded, out/ also has forge-std and the test and script contracts
+//
 //go:embed views assets migrations
+//go:embed out/Investor.sol out/PositionManager.sol out/IERC20.sol out/Store.sol
+//go:embed out/Whitelist.sol out/UtilFarmingBalances.sol out/IMulticall3.sol out/IRodeo.sol
 var FS embed.FS
 
 func main() {
@@ -21,6 +26,7 @@ func main() {
 	lib.SecretsLoad(os.Getenv("SECRET"), secrets[lib.Env("ENV", "development")])
 	s := lib.NewServer(FS)
 	s.ChainClients[42161] = lib.NewChainClient(42161)
+	lib.NewTxManager(s.Database, s.ChainClients[42161])
 	setupRoutes(s)
 	s.Queue.RunCliJob()
 }
@@ -42,7 +42,7 @@ func midSession(c *lib.Ctx) {
 	c.Data["address"] = c.GetCookie("address")
 	if rdoPrice == nil {
 		client := c.Server.ChainClients[models.DefaultChainId]
-		rdoPrice = client.CallUint("0x309349d5D02C6f8b50b5040e9128E1A8375042D7", "latestAnswer--int256")
+		client.CallMethod(&rdoPrice, models.OracleLatestAnswer, "0x309349d5D02C6f8b50b5040e9128E1A8375042D7")
 	}
 	c.Data["priceRdo"] = rdoPrice
 }
@@ -0,0 +1,49 @@
+package migrations
+
+import "app/lib"
+
+var _ = lib.RegisterMigration("20261016100000_positions_index", func(c *lib.Ctx) {
+	c.DB.Execute(`
+ALTER TABLE positions ALTER COLUMN strategy TYPE bigint USING strategy::bigint;
+ALTER TABLE positions ADD COLUMN owner text NOT NULL DEFAULT '';
+ALTER TABLE positions ADD COLUMN token text NOT NULL DEFAULT '';
+ALTER TABLE positions ADD COLUMN collateral decimal NOT NULL DEFAULT 0;
+CREATE INDEX positions_owner_idx ON positions (owner);
+
+CREATE TABLE position_histories (
+  id bigserial NOT NULL PRIMARY KEY,
+  chain int NOT NULL,
+  "index" int NOT NULL,
+  time timestamptz NOT NULL,
+  shares decimal NOT NULL,
+  borrow decimal NOT NULL,
+  shares_value decimal NOT NULL,
+  borrow_value decimal NOT NULL,
+  life decimal NOT NULL,
+  amount decimal NOT NULL,
+  price decimal NOT NULL,
+  event text NOT NULL,
+  block bigint NOT NULL,
+  log_index int NOT NULL
+);
+CREATE UNIQUE INDEX position_histories_log_idx ON position_histories (chain, block, log_index);
+CREATE INDEX position_histories_position_idx ON position_histories (chain, "index", time);
+
+CREATE TABLE indexer_cursors (
+  id text NOT NULL PRIMARY KEY,
+  block bigint NOT NULL,
+  hash text NOT NULL,
+  updated timestamptz NOT NULL DEFAULT now()
+);
+`)
+}, func(c *lib.Ctx) {
+	c.DB.Execute(`
+DROP TABLE indexer_cursors;
+DROP TABLE position_histories;
+DROP INDEX positions_owner_idx;
+ALTER TABLE positions DROP COLUMN collateral;
+ALTER TABLE positions DROP COLUMN token;
+ALTER TABLE positions DROP COLUMN owner;
+ALTER TABLE positions ALTER COLUMN strategy TYPE text;
+`)
+})
@@ -0,0 +1,36 @@
+package migrations
+
+import "app/lib"
+
+// Indexers now keep their cursor in the LogScanner's app_log_cursors table, and the
+// leaderboard keeps the pool transfers it scanned instead of fetching them all each run
+var _ = lib.RegisterMigration("20261016110000_log_cursors", func(c *lib.Ctx) {
+	c.DB.Execute(`
+INSERT INTO app_log_cursors (id, block, hash, size, updated)
+  SELECT id, block, hash, 5000, updated FROM indexer_cursors
+  ON CONFLICT (id) DO NOTHING;
+DROP TABLE indexer_cursors;
+
+CREATE TABLE leaderboards_transfers (
+  block bigint NOT NULL,
+  log_index int NOT NULL,
+  sender text NOT NULL,
+  receiver text NOT NULL,
+  amount decimal NOT NULL,
+  PRIMARY KEY (block, log_index)
+);
+`)
+}, func(c *lib.Ctx) {
+	c.DB.Execute(`
+DROP TABLE leaderboards_transfers;
+
+CREATE TABLE indexer_cursors (
+  id text NOT NULL PRIMARY KEY,
+  block bigint NOT NULL,
+  hash text NOT NULL,
+  updated timestamptz NOT NULL DEFAULT now()
+);
+INSERT INTO indexer_cursors (id, block, hash, updated)
+  SELECT id, block, hash, updated FROM app_log_cursors WHERE id = 'positions';
+`)
+})
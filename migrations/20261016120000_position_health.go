@@ -0,0 +1,38 @@
+package migrations
+
+import "app/lib"
+
+// The health monitor keeps the last level it saw per position apart from the
+// positions table, which the indexer overwrites, and a log of level changes.
+// Pages look healths up by owner whatever the case of the address.
+var _ = lib.RegisterMigration("20261016120000_position_health", func(c *lib.Ctx) {
+	c.DB.Execute(`
+CREATE TABLE position_healths (
+  id bigint NOT NULL PRIMARY KEY,
+  chain int NOT NULL,
+  "index" int NOT NULL,
+  owner text NOT NULL,
+  level text NOT NULL,
+  life decimal NOT NULL,
+  updated timestamptz NOT NULL
+);
+CREATE INDEX position_healths_owner_idx ON position_healths (lower(owner));
+
+CREATE TABLE position_alerts (
+  id bigserial NOT NULL PRIMARY KEY,
+  chain int NOT NULL,
+  "index" int NOT NULL,
+  owner text NOT NULL,
+  level text NOT NULL,
+  previous text NOT NULL,
+  life decimal NOT NULL,
+  created timestamptz NOT NULL
+);
+CREATE INDEX position_alerts_position_idx ON position_alerts (chain, "index", created);
+`)
+}, func(c *lib.Ctx) {
+	c.DB.Execute(`
+DROP TABLE position_alerts;
+DROP TABLE position_healths;
+`)
+})
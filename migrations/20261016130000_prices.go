@@ -0,0 +1,19 @@
+package migrations
+
+import "app/lib"
+
+// Oracle prices sampled over time, keyed by asset and scaled to 18 decimals
+var _ = lib.RegisterMigration("20261016130000_prices", func(c *lib.Ctx) {
+	c.DB.Execute(`
+CREATE TABLE prices (
+  id text NOT NULL,
+  price decimal NOT NULL,
+  time timestamptz NOT NULL,
+  PRIMARY KEY (id, time)
+);
+`)
+}, func(c *lib.Ctx) {
+	c.DB.Execute(`
+DROP TABLE prices;
+`)
+})
@@ -0,0 +1,30 @@
+package migrations
+
+import "app/lib"
+
+// Position histories also get periodic snapshots (log_index -1, so the log
+// index no longer identifies a row on its own) and what's needed for PnL: the
+// collateral's value, the value deposited (or withdrawn when negative) and fees paid.
+// Portfolios and the API look positions up by owner whatever the case of the
+// address, the API paging through them by index.
+var _ = lib.RegisterMigration("20261016140000_portfolio", func(c *lib.Ctx) {
+	c.DB.Execute(`
+ALTER TABLE position_histories ADD COLUMN collateral_value decimal NOT NULL DEFAULT 0;
+ALTER TABLE position_histories ADD COLUMN flow decimal NOT NULL DEFAULT 0;
+ALTER TABLE position_histories ADD COLUMN fee decimal NOT NULL DEFAULT 0;
+UPDATE position_histories SET collateral_value = amount * 1e12;
+DROP INDEX position_histories_log_idx;
+CREATE UNIQUE INDEX position_histories_log_idx ON position_histories (chain, block, log_index, "index");
+CREATE INDEX positions_owner_lower_idx ON positions (chain, lower(owner), "index");
+`)
+}, func(c *lib.Ctx) {
+	c.DB.Execute(`
+DROP INDEX positions_owner_lower_idx;
+DELETE FROM position_histories WHERE log_index < 0;
+DROP INDEX position_histories_log_idx;
+CREATE UNIQUE INDEX position_histories_log_idx ON position_histories (chain, block, log_index);
+ALTER TABLE position_histories DROP COLUMN fee;
+ALTER TABLE position_histories DROP COLUMN flow;
+ALTER TABLE position_histories DROP COLUMN collateral_value;
+`)
+})
@@ -3,11 +3,11 @@ package models
 import "app/lib"
 
 type TokenInfo struct {
-	Address  string
-	Symbol   string
-	Icon     string
-	Decimals int64
-	Oracle   string
+	Address  string `json:"address"`
+	Symbol   string `json:"symbol"`
+	Icon     string `json:"icon"`
+	Decimals int64  `json:"decimals"`
+	Oracle   string `json:"oracle"`
 }
 
 type PoolInfo struct {
@@ -125,12 +125,12 @@ var Tokens = map[string]*TokenInfo{
 }
 
 type Collateral struct {
-	Token           *TokenInfo
-	Price           *lib.BigInt
-	Balance         *lib.BigInt
-	UserBalance     *lib.BigInt
-	PositionBalance *lib.BigInt
-	Cap             *lib.BigInt
+	Token           *TokenInfo  `json:"token"`
+	Price           *lib.BigInt `json:"price"`
+	Balance         *lib.BigInt `json:"balance"`
+	UserBalance     *lib.BigInt `json:"userBalance"`
+	PositionBalance *lib.BigInt `json:"positionBalance"`
+	Cap             *lib.BigInt `json:"cap"`
 }
 
 var Collaterals = []*TokenInfo{
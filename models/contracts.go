@@ -0,0 +1,118 @@
+package models
+
+import (
+	"app/lib"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type InvestorPosition struct {
+	Owner      common.Address
+	Start      *lib.BigInt
+	Strategy   *lib.BigInt
+	Token      common.Address
+	Collateral *lib.BigInt
+	Borrow     *lib.BigInt
+	Shares     *lib.BigInt
+	Basis      *lib.BigInt
+}
+
+type InvestorStrategy struct {
+	Implementation common.Address
+	Cap            *lib.BigInt
+	Status         *lib.BigInt
+}
+
+type InvestorKillResult struct {
+	Token common.Address
+	Data  []byte
+}
+
+type FarmingBalances struct {
+	Users    []common.Address
+	Balances []*lib.BigInt
+}
+
+var InvestorGetPosition = lib.RegisterContractMethod("Investor", "getPosition", InvestorPosition{})
+var InvestorGetStrategy = lib.RegisterContractMethod("Investor", "getStrategy", InvestorStrategy{})
+var InvestorLife = lib.RegisterContractMethod("Investor", "life", &lib.BigInt{})
+var InvestorKill = lib.RegisterContractMethod("Investor", "kill", InvestorKillResult{})
+var InvestorKillRepayment = lib.RegisterContractMethod("Investor", "killRepayment", &lib.BigInt{})
+var InvestorPerformanceFee = lib.RegisterContractMethod("Investor", "performanceFee", &lib.BigInt{})
+
+var PositionManagerBalanceOf = lib.RegisterContractMethod("PositionManager", "balanceOf", &lib.BigInt{})
+var PositionManagerOwnerOf = lib.RegisterContractMethod("PositionManager", "ownerOf", common.Address{})
+var PositionManagerTokensOfOwner = lib.RegisterContractMethod("PositionManager", "tokensOfOwner", []*lib.BigInt{})
+
+var StrategyRate = lib.RegisterContractMethod("Investor.sol/IStrategy", "rate", &lib.BigInt{})
+var StrategyTotalShares = lib.RegisterContractMethod("Investor.sol/IStrategy", "totalShares", &lib.BigInt{})
+
+var OracleDecimals = lib.RegisterContractMethod("Investor.sol/IOracle", "decimals", uint8(0))
+var OracleLatestAnswer = lib.RegisterContractMethod("Investor.sol/IOracle", "latestAnswer", &lib.BigInt{})
+
+var ERC20BalanceOf = lib.RegisterContractMethod("IERC20", "balanceOf", &lib.BigInt{})
+var ERC20Allowance = lib.RegisterContractMethod("IERC20", "allowance", &lib.BigInt{})
+var ERC20TotalSupply = lib.RegisterContractMethod("IERC20", "totalSupply", &lib.BigInt{})
+
+var StoreGetUint = lib.RegisterContractMethod("Store", "getUint", &lib.BigInt{})
+var WhitelistCheck = lib.RegisterContractMethod("Whitelist", "check", false)
+var FarmingBalancesGet = lib.RegisterContractMethod("UtilFarmingBalances", "get", FarmingBalances{})
+
+// Deployed contracts declared in contracts/interfaces/IRodeo.sol
+
+type HelperPool struct {
+	Paused    bool
+	BorrowMin *lib.BigInt
+	Cap       *lib.BigInt
+	Index     *lib.BigInt
+	Shares    *lib.BigInt
+	Borrow    *lib.BigInt
+	Supply    *lib.BigInt
+	Rate      *lib.BigInt
+	Price     *lib.BigInt
+}
+
+type XrdoUser struct {
+	Balance     *lib.BigInt
+	Allocated   *lib.BigInt
+	Allocations []*lib.BigInt
+}
+
+type VesterSchedules struct {
+	Amounts    []*lib.BigInt
+	Claimeds   []*lib.BigInt
+	Availables []*lib.BigInt
+}
+
+type VesterSchedulesInfo struct {
+	Sources  []*lib.BigInt
+	Tokens   []common.Address
+	Initials []*lib.BigInt
+	Times    []*lib.BigInt
+	Starts   []*lib.BigInt
+}
+
+type VaultStrategyInfo struct {
+	Profit   *lib.BigInt
+	Leverage *lib.BigInt
+	Assets   *lib.BigInt
+	Balance  *lib.BigInt
+	Debt     *lib.BigInt
+}
+
+var InvestorKillCollateralPadding = lib.RegisterContractMethod("Investor", "killCollateralPadding", &lib.BigInt{})
+
+var HelperPoolInfo = lib.RegisterContractMethod("IRodeo.sol/IAppHelper", "pool", HelperPool{})
+var LendingPoolTotalLiquidity = lib.RegisterContractMethod("IRodeo.sol/ILendingPool", "getTotalLiquidity", &lib.BigInt{})
+var FarmTvl = lib.RegisterContractMethod("IRodeo.sol/IFarm", "tvl", &lib.BigInt{})
+var XrdoPlugins = lib.RegisterContractMethod("IRodeo.sol/IXrdo", "plugins", &lib.BigInt{})
+var XrdoGetUser = lib.RegisterContractMethod("IRodeo.sol/IXrdo", "getUser", XrdoUser{})
+var StakingDividendsClaimable = lib.RegisterContractMethod("IRodeo.sol/ITokenStakingDividends", "claimable", &lib.BigInt{})
+var STIPDistributorGetClaimed = lib.RegisterContractMethod("IRodeo.sol/ISTIPDistributor", "getClaimed", []*lib.BigInt{})
+var VesterSchedulesCount = lib.RegisterContractMethod("IRodeo.sol/IVester", "schedulesCount", &lib.BigInt{})
+var VesterGetSchedules = lib.RegisterContractMethod("IRodeo.sol/IVester", "getSchedules", VesterSchedules{})
+var VesterGetSchedulesInfo = lib.RegisterContractMethod("IRodeo.sol/IVester", "getSchedulesInfo", VesterSchedulesInfo{})
+var AutomationCanRun = lib.RegisterContractMethod("IRodeo.sol/IAutomation", "canRun", []byte{})
+var AutomationRun = lib.RegisterContractMethod("IRodeo.sol/IAutomation", "run", nil)
+var VaultStrategyInfoGet = lib.RegisterContractMethod("IRodeo.sol/IVaultStrategy", "info", VaultStrategyInfo{})
+var VaultStrategyAct = lib.RegisterContractMethod("IRodeo.sol/IVaultStrategy", "act", nil)
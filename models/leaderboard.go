@@ -29,29 +29,41 @@ type LeaderboardPoint struct {
 }
 
 func LeaderboardPointCredit(c *lib.Ctx, id, reason, reasonID string, points int64) {
-	pointID := lib.NewID()
-	for id != "" {
-		if points == 0 {
-			break
+	// The ledger and the totals up the referral chain move together, or not at all
+	lib.Check(c.DB.Tx(func(tx *lib.Database) error {
+		pointID := lib.NewID()
+		for id != "" {
+			if points == 0 {
+				break
+			}
+			u := &LeaderboardUser{}
+			if err := tx.MustFirstWhereForUpdateErr(u, "id = $1", id); err != nil {
+				return err
+			}
+			err := tx.PutErr(&LeaderboardPoint{
+				ID:       lib.NewID(),
+				UserID:   id,
+				Reason:   reason,
+				ReasonID: reasonID,
+				Points:   points,
+				Created:  time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+			if reason == "referral" {
+				err = tx.ExecuteErr("update leaderboards_users set points = points + $2 where id = $1", id, points)
+			} else {
+				err = tx.ExecuteErr("update leaderboards_users set points = points + $2, points_referral = points_referral + $2 where id = $1", id, points)
+			}
+			if err != nil {
+				return err
+			}
+			reason = "referral"
+			reasonID = pointID
+			id = u.Referrer
+			points = points / 4
 		}
-		u := &LeaderboardUser{}
-		c.DB.MustFirstWhere(u, "id = $1", id)
-		c.DB.Put(&LeaderboardPoint{
-			ID:       lib.NewID(),
-			UserID:   id,
-			Reason:   reason,
-			ReasonID: reasonID,
-			Points:   points,
-			Created:  time.Now(),
-		})
-		if reason == "referral" {
-			c.DB.Execute("update leaderboards_users set points = points + $2 where id = $1", id, points)
-		} else {
-			c.DB.Execute("update leaderboards_users set points = points + $2, points_referral = points_referral + $2 where id = $1", id, points)
-		}
-		reason = "referral"
-		reasonID = pointID
-		id = u.Referrer
-		points = points / 4
-	}
+		return nil
+	}))
 }
@@ -3,6 +3,7 @@ package models
 var DefaultChainId int64 = 42161
 var AddressHelper = "0x988826F0fCDA660e769558A0bDDfE0ba6aDfFB8F"
 var AddressRdo = "0x033f193b3Fceb22a440e89A2867E8FEE181594D9"
+var AddressArb = "0x912CE59144191C1204E64559FE8253a0e49E6548"
 var AddressXrdo = "0x45a58482c3B8Ce0e8435E407fC7d34266f0A010D"
 var AddressPool = "0x0032F5E1520a66C6E572e96A11fBF54aea26f9bE"
 var AddressInvestor = "0x780D46fef77ac5f83399BD2BE363125982A78973"
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"app/lib"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PortfolioDay sums up an address's positions over a day. Value and Pnl are
+// as of the end of the day, the other amounts are what happened during it.
+type PortfolioDay struct {
+	Date        time.Time   `json:"date"`
+	Value       *lib.BigInt `json:"value"`
+	Pnl         *lib.BigInt `json:"pnl"`
+	DailyPnl    *lib.BigInt `json:"dailyPnl"`
+	Deposits    *lib.BigInt `json:"deposits"`
+	Withdrawals *lib.BigInt `json:"withdrawals"`
+	Fees        *lib.BigInt `json:"fees"`
+	Interest    *lib.BigInt `json:"interest"`
+}
+
+// Portfolio is the PnL of an address's positions, in USD with 18 decimals.
+// Closed positions' PnL is realised, open ones' is unrealised, both being
+// their value plus what came out of them minus what went in.
+type Portfolio struct {
+	Address     string          `json:"address"`
+	Value       *lib.BigInt     `json:"value"`
+	Deposits    *lib.BigInt     `json:"deposits"`
+	Withdrawals *lib.BigInt     `json:"withdrawals"`
+	Realised    *lib.BigInt     `json:"realised"`
+	Unrealised  *lib.BigInt     `json:"unrealised"`
+	Fees        *lib.BigInt     `json:"fees"`
+	Interest    *lib.BigInt     `json:"interest"`
+	Days        []*PortfolioDay `json:"days"`
+}
+
+// portfolioTotals is what the histories of a position before the days broken
+// down add up to
+type portfolioTotals struct {
+	Index       int64
+	Flow        *lib.BigInt
+	Deposits    *lib.BigInt
+	Withdrawals *lib.BigInt
+	Fees        *lib.BigInt
+	Interest    *lib.BigInt
+}
+
+// portfolioTotalsQuery sums up histories before $3, interest being the growth
+// of the borrow at the pool index since the previous record like in PortfolioFor
+const portfolioTotalsQuery = `select "index",
+  coalesce(sum(flow), 0) flow,
+  coalesce(sum(flow) filter (where flow > 0), 0) deposits,
+  coalesce(-sum(flow) filter (where flow < 0), 0) withdrawals,
+  coalesce(sum(fee), 0) fees,
+  coalesce(sum(interest) filter (where interest > 0), 0) interest
+from (
+  select *, case when prev_borrow > 0 and borrow > 0 then
+    trunc(prev_borrow * (trunc(borrow_value * 1e18 / borrow) - trunc(prev_borrow_value * 1e18 / prev_borrow)) / 1e18) * 1e12 end interest
+  from (
+    select "index", flow, fee, borrow, borrow_value,
+      lag(borrow) over w prev_borrow, lag(borrow_value) over w prev_borrow_value
+    from position_histories where chain = $1 and "index" = any($2) and time < $3
+    window w as (partition by "index" order by time, block, log_index)
+  ) h
+) h group by "index"`
+
+// PortfolioFor builds the portfolio of the positions owned by address from
+// their histories, with a day by day breakdown of the last `days` days. Only
+// the histories of those days are loaded, what came before is summed up in SQL.
+func PortfolioFor(c *lib.Ctx, address string, days int) *Portfolio {
+	p := &Portfolio{Address: address, Value: lib.ZERO, Deposits: lib.ZERO, Withdrawals: lib.ZERO,
+		Realised: lib.ZERO, Unrealised: lib.ZERO, Fees: lib.ZERO, Interest: lib.ZERO, Days: []*PortfolioDay{}}
+	positions := []*Position{}
+	c.DB.All(&positions, `select * from positions where chain = $1 and lower(owner) = lower($2)`, DefaultChainId, address)
+	if len(positions) == 0 {
+		return p
+	}
+	indexes := []int64{}
+	for _, position := range positions {
+		indexes = append(indexes, position.Index)
+	}
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+	totals := []*portfolioTotals{}
+	c.DB.All(&totals, portfolioTotalsQuery, DefaultChainId, pq.Array(indexes), start)
+	// The last record of each position before start is where its days pick up from
+	previous := []*PositionHistory{}
+	c.DB.All(&previous, `select distinct on ("index") * from position_histories where chain = $1 and "index" = any($2) and time < $3
+order by "index", time desc, block desc, log_index desc`, DefaultChainId, pq.Array(indexes), start)
+	histories := []*PositionHistory{}
+	c.DB.All(&histories, `select * from position_histories where chain = $1 and "index" = any($2) and time >= $3 order by time, block, log_index`,
+		DefaultChainId, pq.Array(indexes), start)
+
+	last := map[int64]*PositionHistory{}
+	flows := map[int64]*lib.BigInt{}
+	for _, t := range totals {
+		p.Deposits = p.Deposits.Add(t.Deposits)
+		p.Withdrawals = p.Withdrawals.Add(t.Withdrawals)
+		p.Fees = p.Fees.Add(t.Fees)
+		p.Interest = p.Interest.Add(t.Interest)
+		flows[t.Index] = t.Flow
+	}
+	var day *PortfolioDay
+	previousPnl := lib.ZERO
+	if len(previous) > 0 {
+		for _, h := range previous {
+			last[h.Index] = h
+			previousPnl = previousPnl.Add(h.Equity())
+		}
+		previousPnl = previousPnl.Sub(p.Deposits).Add(p.Withdrawals)
+		day = &PortfolioDay{Date: start, Deposits: lib.ZERO, Withdrawals: lib.ZERO, Fees: lib.ZERO, Interest: lib.ZERO}
+	}
+	// closeDay values the positions at the end of the current day before moving on
+	closeDay := func() {
+		if day == nil {
+			return
+		}
+		day.Value = lib.ZERO
+		for _, h := range last {
+			day.Value = day.Value.Add(h.Equity())
+		}
+		day.Pnl = day.Value.Sub(p.Deposits).Add(p.Withdrawals)
+		day.DailyPnl = day.Pnl.Sub(previousPnl)
+		previousPnl = day.Pnl
+		if !day.Date.Before(start) {
+			p.Days = append(p.Days, day)
+		}
+	}
+	for _, h := range histories {
+		date := h.Time.UTC().Truncate(24 * time.Hour)
+		for day == nil || day.Date.Before(date) {
+			closeDay()
+			next := date
+			if day != nil {
+				next = day.Date.AddDate(0, 0, 1)
+			}
+			day = &PortfolioDay{Date: next, Deposits: lib.ZERO, Withdrawals: lib.ZERO, Fees: lib.ZERO, Interest: lib.ZERO}
+		}
+		// Interest is the growth of the borrow at the pool index since the last record
+		if prev := last[h.Index]; prev != nil && prev.Borrow.Gt(lib.ZERO) && h.Borrow.Gt(lib.ZERO) {
+			interest := prev.Borrow.Mul(h.BorrowValue.Mul(lib.ONE).Div(h.Borrow).Sub(prev.BorrowValue.Mul(lib.ONE).Div(prev.Borrow))).Div(lib.ONE).Mul(lib.ONE12)
+			if interest.Gt(lib.ZERO) {
+				day.Interest = day.Interest.Add(interest)
+				p.Interest = p.Interest.Add(interest)
+			}
+		}
+		if h.Flow.Gt(lib.ZERO) {
+			day.Deposits = day.Deposits.Add(h.Flow)
+			p.Deposits = p.Deposits.Add(h.Flow)
+		} else {
+			day.Withdrawals = day.Withdrawals.Sub(h.Flow)
+			p.Withdrawals = p.Withdrawals.Sub(h.Flow)
+		}
+		day.Fees = day.Fees.Add(h.Fee)
+		p.Fees = p.Fees.Add(h.Fee)
+		if flows[h.Index] == nil {
+			flows[h.Index] = lib.ZERO
+		}
+		flows[h.Index] = flows[h.Index].Add(h.Flow)
+		last[h.Index] = h
+	}
+	// Carry the last known values over to today
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for day != nil && !day.Date.After(today) {
+		closeDay()
+		day = &PortfolioDay{Date: day.Date.AddDate(0, 0, 1), Deposits: lib.ZERO, Withdrawals: lib.ZERO, Fees: lib.ZERO, Interest: lib.ZERO}
+	}
+
+	for index, h := range last {
+		p.Value = p.Value.Add(h.Equity())
+		if h.Shares.Eq(lib.ZERO) && h.Borrow.Eq(lib.ZERO) {
+			// Whatever collateral a kill left is the owner's to withdraw
+			p.Realised = p.Realised.Add(h.Equity()).Sub(flows[index])
+		} else {
+			p.Unrealised = p.Unrealised.Add(h.Equity()).Sub(flows[index])
+		}
+	}
+	return p
+}
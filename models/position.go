@@ -11,12 +11,6 @@ type Earn struct {
 	Next time.Time
 }
 
-type Price struct {
-	Id    string      `json:"asset"`
-	Price *lib.BigInt `json:"price"`
-	Time  time.Time   `json:"time"`
-}
-
 type Position struct {
 	Id          int64       `json:"id"`
 	Chain       int64       `json:"chain"`
@@ -33,6 +27,7 @@ type Position struct {
 	Created     time.Time   `json:"created"`
 	Updated     time.Time   `json:"updated"`
 
+	Owner      string      `json:"owner"`
 	Token      string      `json:"token"`
 	Collateral *lib.BigInt `json:"collateral"`
 }
@@ -53,15 +48,77 @@ func (p *Position) ProfitPercent() *lib.BigInt {
 }
 
 type PositionHistory struct {
-	Id          int64       `json:"id"`
-	Chain       int64       `json:"chain"`
-	Index       int64       `json:"index"`
-	Time        time.Time   `json:"time"`
-	Shares      *lib.BigInt `json:"shares"`
-	Borrow      *lib.BigInt `json:"borrow"`
-	SharesValue *lib.BigInt `json:"shares_value"`
-	BorrowValue *lib.BigInt `json:"borrow_value"`
-	Life        *lib.BigInt `json:"life"`
-	Amount      *lib.BigInt `json:"amount"`
-	Price       *lib.BigInt `json:"price"`
+	Id              int64       `json:"id"`
+	Chain           int64       `json:"chain"`
+	Index           int64       `json:"index"`
+	Time            time.Time   `json:"time"`
+	Shares          *lib.BigInt `json:"shares"`
+	Borrow          *lib.BigInt `json:"borrow"`
+	SharesValue     *lib.BigInt `json:"shares_value"`
+	BorrowValue     *lib.BigInt `json:"borrow_value"`
+	Life            *lib.BigInt `json:"life"`
+	Amount          *lib.BigInt `json:"amount"`
+	Price           *lib.BigInt `json:"price"`
+	Event           string      `json:"event"`
+	Block           int64       `json:"block"`
+	LogIndex        int64       `json:"log_index"`
+	CollateralValue *lib.BigInt `json:"collateral_value"`
+	Flow            *lib.BigInt `json:"flow"`
+	Fee             *lib.BigInt `json:"fee"`
+}
+
+func (h *PositionHistory) TableName() string { return "position_histories" }
+
+// Equity is what the position is worth to its owner, collateral included
+func (h *PositionHistory) Equity() *lib.BigInt {
+	return h.SharesValue.Add(h.CollateralValue).Sub(h.BorrowValue.Mul(lib.ONE12))
 }
+
+// Position health levels, from safest to about to be killed
+const (
+	PositionHealthOk           = "ok"
+	PositionHealthWarning      = "warning"
+	PositionHealthCritical     = "critical"
+	PositionHealthLiquidatable = "liquidatable"
+)
+
+var PositionHealthLevels = []string{PositionHealthOk, PositionHealthWarning, PositionHealthCritical, PositionHealthLiquidatable}
+
+type PositionHealth struct {
+	Id      int64       `json:"id"`
+	Chain   int64       `json:"chain"`
+	Index   int64       `json:"index"`
+	Owner   string      `json:"owner"`
+	Level   string      `json:"level"`
+	Life    *lib.BigInt `json:"life"`
+	Updated time.Time   `json:"updated"`
+}
+
+func (h *PositionHealth) TableName() string { return "position_healths" }
+
+// Severity orders levels, higher is closer to liquidation
+func (h *PositionHealth) Severity() int {
+	return PositionHealthSeverity(h.Level)
+}
+
+func PositionHealthSeverity(level string) int {
+	for i, l := range PositionHealthLevels {
+		if l == level {
+			return i
+		}
+	}
+	return 0
+}
+
+type PositionAlert struct {
+	Id       int64       `json:"id"`
+	Chain    int64       `json:"chain"`
+	Index    int64       `json:"index"`
+	Owner    string      `json:"owner"`
+	Level    string      `json:"level"`
+	Previous string      `json:"previous"`
+	Life     *lib.BigInt `json:"life"`
+	Created  time.Time   `json:"created"`
+}
+
+func (a *PositionAlert) TableName() string { return "position_alerts" }
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"app/lib"
+	"time"
+)
+
+type Price struct {
+	Id    string      `json:"asset"`
+	Price *lib.BigInt `json:"price"`
+	Time  time.Time   `json:"time"`
+}
+
+type PriceCandle struct {
+	Time  time.Time   `json:"time"`
+	Open  *lib.BigInt `json:"open"`
+	High  *lib.BigInt `json:"high"`
+	Low   *lib.BigInt `json:"low"`
+	Close *lib.BigInt `json:"close"`
+}
+
+type PriceFeed struct {
+	Asset  string
+	Oracle string
+}
+
+// PriceFeeds are the oracles sampled into prices, the collateral tokens' plus RDO and ARB
+var PriceFeeds = []*PriceFeed{
+	{Asset: AddressRdo, Oracle: "0x309349d5D02C6f8b50b5040e9128E1A8375042D7"},
+	{Asset: AddressArb, Oracle: "0xb2A824043730FE05F3DA2efaFa1CBbe83fa548D6"},
+}
+
+func init() {
+	for _, t := range Tokens {
+		PriceFeeds = append(PriceFeeds, &PriceFeed{Asset: t.Address, Oracle: t.Oracle})
+	}
+}
+
+// PriceAt returns the last price sampled for asset at or before t, nil when
+// there's none
+func PriceAt(c *lib.Ctx, asset string, t time.Time) *Price {
+	p, err := PriceAtErr(c, asset, t)
+	if err == lib.ErrDatabaseNotFound {
+		return nil
+	}
+	lib.Check(err)
+	return p
+}
+
+// PriceAtErr returns the last price sampled for asset at or before t, or
+// ErrDatabaseNotFound when there's none
+func PriceAtErr(c *lib.Ctx, asset string, t time.Time) (*Price, error) {
+	p := &Price{}
+	err := c.DB.FirstErr(p, `select * from prices where id = $1 and time <= $2 order by time desc limit 1`, asset, t)
+	return p, err
+}
+
+// PriceCandles returns the open, high, low and close prices of asset for each
+// interval between from and to, skipping intervals without samples
+func PriceCandles(c *lib.Ctx, asset string, from, to time.Time, interval time.Duration) []*PriceCandle {
+	candles := []*PriceCandle{}
+	c.DB.All(&candles, `select to_timestamp(floor(extract(epoch from time) / $4) * $4) as time,
+  (array_agg(price order by time asc))[1] as open, max(price) as high,
+  min(price) as low, (array_agg(price order by time desc))[1] as close
+from prices where id = $1 and time >= $2 and time < $3
+group by 1 order by 1`, asset, from, to, int64(interval.Seconds()))
+	return candles
+}
+
+// PriceTWAP returns the time weighted average price of asset between from and
+// to, each sample counting until the next one. Nil when there's no sample at or before from.
+func PriceTWAP(c *lib.Ctx, asset string, from, to time.Time) *lib.BigInt {
+	start, err := PriceAtErr(c, asset, from)
+	if err == lib.ErrDatabaseNotFound {
+		return nil
+	}
+	lib.Check(err)
+	samples := []*Price{}
+	c.DB.All(&samples, `select * from prices where id = $1 and time > $2 and time < $3 order by time`, asset, from, to)
+	start.Time = from
+	samples = append([]*Price{start}, samples...)
+	sum := lib.ZERO
+	for i, p := range samples {
+		end := to
+		if i+1 < len(samples) {
+			end = samples[i+1].Time
+		}
+		sum = sum.Add(p.Price.Mul(lib.Bn(end.Sub(p.Time).Milliseconds(), 0)))
+	}
+	elapsed := to.Sub(from).Milliseconds()
+	if elapsed <= 0 {
+		return start.Price
+	}
+	return sum.Div(lib.Bn(elapsed, 0))
+}